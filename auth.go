@@ -37,8 +37,14 @@ func jwtKeyFunc(*jwt.Token) (interface{}, error) {
 
 // Validate request body
 func (input *PasswordlessStartInput) Validate() map[string]string {
-	// TODO: actual validation
-	return nil
+	errs := make(map[string]string)
+
+	input.Email = strings.TrimSpace(input.Email)
+	if err := validateEmail(input.Email); err != "" {
+		errs["email"] = err
+	}
+
+	return errs
 }
 
 func passwordlessStart(w http.ResponseWriter, r *http.Request) {
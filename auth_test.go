@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordlessStartInputValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  map[string]string
+	}{
+		{"valid", "john@example.org", map[string]string{}},
+		{"trimmed", "  john@example.org\n", map[string]string{}},
+		{"empty", "", map[string]string{"email": "Email required"}},
+		{"blank", "   ", map[string]string{"email": "Email required"}},
+		{"no at", "john.example.org", map[string]string{"email": "Invalid email"}},
+		{"no domain dot", "john@example", map[string]string{"email": "Invalid email"}},
+		{"spaces", "john doe@example.org", map[string]string{"email": "Invalid email"}},
+		{"max length", strings.Repeat("a", emailMaxLength-6) + "@a.org", map[string]string{}},
+		{"too long", strings.Repeat("a", emailMaxLength-5) + "@a.org", map[string]string{"email": "Invalid email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := PasswordlessStartInput{Email: tt.email}
+			if got := input.Validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+			if input.Email != strings.TrimSpace(tt.email) {
+				t.Errorf("email not trimmed: %q", input.Email)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	avatarSizeSmall  = 48
+	avatarSizeMedium = 128
+	avatarSizeLarge  = 400
+	// avatarMaxPixels guards against decoding huge images,
+	// a small file can claim dimensions that take gigabytes to decode.
+	avatarMaxPixels   = 4096 * 4096
+	avatarJPEGQuality = 85
+)
+
+// avatarSizes are the square variants every avatar gets resized to.
+// avatar_url is the storage name of the medium one.
+var avatarSizes = []int{avatarSizeSmall, avatarSizeMedium, avatarSizeLarge}
+
+var errAvatarTooBig = errors.New("avatar too big")
+
+// AvatarURLs of the size variants of an avatar.
+type AvatarURLs struct {
+	Small  string `json:"small"`
+	Medium string `json:"medium"`
+	Large  string `json:"large"`
+}
+
+// MarshalJSON turns the stored avatar into URLs, adding the size variants.
+func (u User) MarshalJSON() ([]byte, error) {
+	type alias User
+	avatarURL := resolveAvatarURL(u.AvatarURL)
+	return json.Marshal(struct {
+		alias
+		AvatarURL  *string     `json:"avatarUrl"`
+		AvatarURLs *AvatarURLs `json:"avatarUrls,omitempty"`
+	}{alias(u), avatarURL, avatarURLs(avatarURL)})
+}
+
+// MarshalJSON turns the stored avatar into URLs, adding the size variants.
+func (p Profile) MarshalJSON() ([]byte, error) {
+	type alias Profile
+	avatarURL := resolveAvatarURL(p.AvatarURL)
+	return json.Marshal(struct {
+		alias
+		AvatarURL  *string     `json:"avatarUrl"`
+		AvatarURLs *AvatarURLs `json:"avatarUrls,omitempty"`
+	}{alias(p), avatarURL, avatarURLs(avatarURL)})
+}
+
+// resolveAvatarURL builds the public URL of a stored avatar,
+// so it follows the storage and CDN in use.
+// Avatars saved as absolute URLs, before they were stored by name, are kept as is.
+func resolveAvatarURL(avatar *string) *string {
+	if avatar == nil || strings.Contains(*avatar, "://") {
+		return avatar
+	}
+
+	avatarURL := storageURL(*avatar)
+	return &avatarURL
+}
+
+// avatarSuffix is what the URL of the given avatar variant ends with.
+func avatarSuffix(size int) string {
+	return "-" + strconv.Itoa(size) + ".jpg"
+}
+
+// avatarURLs derives the variants from the URL of the medium one.
+// Avatars uploaded before they were resized have none.
+func avatarURLs(avatarURL *string) *AvatarURLs {
+	if avatarURL == nil || !strings.HasSuffix(*avatarURL, avatarSuffix(avatarSizeMedium)) {
+		return nil
+	}
+
+	base := strings.TrimSuffix(*avatarURL, avatarSuffix(avatarSizeMedium))
+	return &AvatarURLs{
+		Small:  base + avatarSuffix(avatarSizeSmall),
+		Medium: *avatarURL,
+		Large:  base + avatarSuffix(avatarSizeLarge),
+	}
+}
+
+// removeAvatarFiles deletes the size variants of a replaced avatar,
+// given the storage name of the medium one.
+// Failures are just logged; the user has a new avatar already.
+func removeAvatarFiles(ctx context.Context, avatar string) {
+	base := strings.TrimSuffix(avatar, avatarSuffix(avatarSizeMedium))
+	for _, size := range avatarSizes {
+		if err := storage.Delete(ctx, base+avatarSuffix(size)); err != nil {
+			log.Printf("could not remove avatar file: %v\n", err)
+		}
+	}
+}
+
+// processAvatar decodes the image, crops it to a centered square
+// and encodes it as JPEG in each of the avatarSizes.
+// Re-encoding drops any metadata, like EXIF location.
+func processAvatar(b []byte) (map[int][]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode avatar config: %v", err)
+	}
+
+	if config.Width*config.Height > avatarMaxPixels {
+		return nil, errAvatarTooBig
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(b), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode avatar: %v", err)
+	}
+
+	variants := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		square := imaging.Fill(img, size, size, imaging.Center, imaging.Lanczos)
+		// JPEG has no transparency, so it gets a white background.
+		flat := imaging.Overlay(imaging.New(size, size, color.White), square, image.Pt(0, 0), 1)
+
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			return nil, fmt.Errorf("could not encode avatar: %v", err)
+		}
+		variants[size] = buf.Bytes()
+	}
+
+	return variants, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+func TestUserMarshalJSONAvatar(t *testing.T) {
+	prevBaseURL := storageBaseURL
+	defer func() { storageBaseURL = prevBaseURL }()
+	storageBaseURL = &url.URL{Scheme: "https", Host: "cdn.example.com", Path: "/nakama/"}
+
+	tt := []struct {
+		name   string
+		avatar *string
+		want   string
+	}{
+		{name: "none", want: `{"username":"john","avatarUrl":null}`},
+		{
+			name:   "stored",
+			avatar: strPtr("avatars/1-abc-128.jpg"),
+			want: `{"username":"john","avatarUrl":"https://cdn.example.com/nakama/avatars/1-abc-128.jpg","avatarUrls":{` +
+				`"small":"https://cdn.example.com/nakama/avatars/1-abc-48.jpg",` +
+				`"medium":"https://cdn.example.com/nakama/avatars/1-abc-128.jpg",` +
+				`"large":"https://cdn.example.com/nakama/avatars/1-abc-400.jpg"}}`,
+		},
+		{
+			name:   "absolute",
+			avatar: strPtr("http://localhost/avatars/1.png"),
+			want:   `{"username":"john","avatarUrl":"http://localhost/avatars/1.png"}`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(User{Username: "john", AvatarURL: tc.avatar})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.want {
+				t.Errorf("got %s, want %s", b, tc.want)
+			}
+		})
+	}
+}
+
+func TestProcessAvatar(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 600, 300))); err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := processAvatar(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range avatarSizes {
+		config, format, err := image.DecodeConfig(bytes.NewReader(variants[size]))
+		if err != nil {
+			t.Fatalf("could not decode %d variant: %v", size, err)
+		}
+		if format != "jpeg" || config.Width != size || config.Height != size {
+			t.Errorf("%d variant is a %dx%d %s", size, config.Width, config.Height, format)
+		}
+	}
+}
+
+func TestProcessAvatarTooBig(t *testing.T) {
+	tt := []struct {
+		name          string
+		width, height uint16
+	}{
+		{name: "wide", width: 65535, height: 300},
+		{name: "square", width: 4097, height: 4097},
+		{name: "tall", width: 300, height: 65535},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// Just a GIF header, decoding its pixels would take a lot of memory.
+			b := []byte("GIF89a")
+			b = append(b, byte(tc.width), byte(tc.width>>8), byte(tc.height), byte(tc.height>>8), 0, 0, 0)
+
+			if _, err := processAvatar(b); err != errAvatarTooBig {
+				t.Errorf("got err %v, want %v", err, errAvatarTooBig)
+			}
+		})
+	}
+}
@@ -1,125 +1,225 @@
 package main
 
-// FeedBrokerClient to register in the broker
-type FeedBrokerClient struct {
-	UserID string
-	Ch     chan FeedItem
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// clientBufferSize is how many messages can be queued for a single client.
+// The broker never blocks on a client: when its buffer is full the client is
+// considered too slow, it gets unregistered and its channel closed, so the
+// handler returns and the browser's EventSource reconnects on its own.
+const clientBufferSize = 16
+
+// Message published to a topic.
+// Data is already JSON encoded so it gets marshaled once per publish
+// and not once per subscriber.
+// Event names messages that aren't the usual ones of the topic,
+// like removals; streams send it instead of their own event name.
+type Message struct {
+	Topic   string          `json:"topic"`
+	Event   string          `json:"event,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	ActorID string          `json:"actorId,omitempty"`
+	Data    json.RawMessage `json:"data"`
 }
 
-// FeedBroker fan-outs from the notifier to all clients
-type FeedBroker struct {
-	Clients  map[FeedBrokerClient]struct{}
-	Notifier chan FeedItem
+// BrokerBackend carries published messages to every broker sharing it.
+// The in-memory backend only reaches this process;
+// networked ones let several nakama instances serve the same users.
+type BrokerBackend interface {
+	Publish(msg Message) error
+	// Messages published by any instance, this one included.
+	Messages() <-chan Message
+	Close() error
+}
+
+var errBrokerClosed = errors.New("broker closed")
+
+type memoryBrokerBackend struct {
+	messages chan Message
+	quit     chan struct{}
 }
 
-// CommentsBrokerClient to register in the broker
-type CommentsBrokerClient struct {
-	UserID string
-	PostID string
-	Ch     chan Comment
+func newMemoryBrokerBackend() *memoryBrokerBackend {
+	return &memoryBrokerBackend{
+		messages: make(chan Message, 1),
+		quit:     make(chan struct{}),
+	}
+}
+
+func (b *memoryBrokerBackend) Publish(msg Message) error {
+	select {
+	case b.messages <- msg:
+		return nil
+	case <-b.quit:
+		return errBrokerClosed
+	}
 }
 
-// CommentsBroker fan-outs from the notifier to all clients
-type CommentsBroker struct {
-	Clients  map[CommentsBrokerClient]struct{}
-	Notifier chan Comment
+func (b *memoryBrokerBackend) Messages() <-chan Message {
+	return b.messages
 }
 
-// NotificationsBrokerClient to register in the broker
-type NotificationsBrokerClient struct {
-	UserID string
-	Ch     chan Notification
+func (b *memoryBrokerBackend) Close() error {
+	close(b.quit)
+	return nil
 }
 
-// NotificationsBroker fan-outs from the notifier to all clients
-type NotificationsBroker struct {
-	Clients  map[NotificationsBrokerClient]struct{}
-	Notifier chan Notification
+type brokerClient struct {
+	topics []string
+	ch     chan Message
 }
 
-func newFeedBroker() *FeedBroker {
-	b := FeedBroker{
-		Clients:  make(map[FeedBrokerClient]struct{}),
-		Notifier: make(chan FeedItem, 1),
+// Broker fan-outs published messages to the clients subscribed to its topic.
+// Topics are plain strings like "feed:<user_id>" or "comments:<post_id>";
+// see the *Topic helpers next to each model.
+// Clients are owned by the loop goroutine; subscribe and unsubscribe
+// talk to it through channels, while publish goes through the backend.
+type Broker struct {
+	backend    BrokerBackend
+	register   chan *brokerClient
+	unregister chan *brokerClient
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+func newBroker(backend BrokerBackend) *Broker {
+	b := Broker{
+		backend:    backend,
+		register:   make(chan *brokerClient),
+		unregister: make(chan *brokerClient),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 	go b.loop()
 	return &b
 }
 
-func (b *FeedBroker) loop() {
-	for feedItem := range b.Notifier {
-		for client := range b.Clients {
-			if client.UserID == feedItem.UserID {
-				client.Ch <- feedItem
+func (b *Broker) loop() {
+	topics := make(map[string]map[*brokerClient]struct{})
+	drop := func(client *brokerClient) {
+		for _, topic := range client.topics {
+			delete(topics[topic], client)
+			if len(topics[topic]) == 0 {
+				delete(topics, topic)
 			}
 		}
+		close(client.ch)
 	}
-}
+	defer close(b.done)
+	defer func() {
+		closed := make(map[*brokerClient]struct{})
+		for _, clients := range topics {
+			for client := range clients {
+				if _, ok := closed[client]; !ok {
+					closed[client] = struct{}{}
+					close(client.ch)
+				}
+			}
+		}
+	}()
 
-func (b *FeedBroker) subscribe(userID string) (chan FeedItem, func()) {
-	ch := make(chan FeedItem)
-	client := FeedBrokerClient{userID, ch}
-	b.Clients[client] = struct{}{}
-	return ch, func() {
-		delete(b.Clients, client)
-		close(ch)
+	for {
+		select {
+		case <-b.quit:
+			return
+		case client := <-b.register:
+			for _, topic := range client.topics {
+				if _, ok := topics[topic]; !ok {
+					topics[topic] = make(map[*brokerClient]struct{})
+				}
+				topics[topic][client] = struct{}{}
+			}
+		case client := <-b.unregister:
+			if _, ok := topics[client.topics[0]][client]; ok {
+				drop(client)
+			}
+		case msg, ok := <-b.backend.Messages():
+			if !ok {
+				return
+			}
+			for client := range topics[msg.Topic] {
+				select {
+				case client.ch <- msg:
+				default:
+					drop(client)
+				}
+			}
+		}
 	}
 }
 
-func newCommentsBroker() *CommentsBroker {
-	b := CommentsBroker{
-		Clients:  make(map[CommentsBrokerClient]struct{}),
-		Notifier: make(chan Comment, 1),
+// subscribe to the given topics. All of them are delivered on the same channel,
+// which gets closed once unsubscribed, or earlier if the client falls behind.
+func (b *Broker) subscribe(topics ...string) (<-chan Message, func()) {
+	client := &brokerClient{topics, make(chan Message, clientBufferSize)}
+	if len(topics) == 0 {
+		close(client.ch)
+		return client.ch, func() {}
 	}
-	go b.loop()
-	return &b
-}
 
-func (b *CommentsBroker) loop() {
-	for comment := range b.Notifier {
-		for client := range b.Clients {
-			if client.UserID != comment.UserID && client.PostID == comment.PostID {
-				client.Ch <- comment
-			}
+	select {
+	case b.register <- client:
+	case <-b.done:
+		close(client.ch)
+	}
+	return client.ch, func() {
+		select {
+		case b.unregister <- client:
+		case <-b.done:
 		}
 	}
 }
 
-func (b *CommentsBroker) subscribe(userID, postID string) (chan Comment, func()) {
-	ch := make(chan Comment)
-	client := CommentsBrokerClient{userID, postID, ch}
-	b.Clients[client] = struct{}{}
-	return ch, func() {
-		delete(b.Clients, client)
-		close(ch)
+// publish v to everyone subscribed to topic.
+// id is the database id of v, used by clients to resume.
+// actorID is the user that caused the message, if any,
+// so subscribers can skip their own actions.
+func (b *Broker) publish(topic, id, actorID string, v interface{}) {
+	msg, err := newMessage(topic, id, actorID, v)
+	if err != nil {
+		log.Println(err)
+		return
 	}
+
+	b.send(msg)
 }
 
-func newNotificationsBroker() *NotificationsBroker {
-	b := NotificationsBroker{
-		Clients:  make(map[NotificationsBrokerClient]struct{}),
-		Notifier: make(chan Notification, 1),
+// publishEvent publishes v to topic as the given event.
+// These messages have no id, so they aren't replayed.
+func (b *Broker) publishEvent(topic, event, actorID string, v interface{}) {
+	msg, err := newMessage(topic, "", actorID, v)
+	if err != nil {
+		log.Println(err)
+		return
 	}
-	go b.loop()
-	return &b
+
+	msg.Event = event
+	b.send(msg)
 }
 
-func (b *NotificationsBroker) loop() {
-	for notification := range b.Notifier {
-		for client := range b.Clients {
-			if client.UserID == notification.UserID {
-				client.Ch <- notification
-			}
-		}
+func (b *Broker) send(msg Message) {
+	if err := b.backend.Publish(msg); err != nil {
+		log.Printf("could not publish %s message: %v\n", msg.Topic, err)
 	}
 }
 
-func (b *NotificationsBroker) subscribe(userID string) (chan Notification, func()) {
-	ch := make(chan Notification)
-	client := NotificationsBrokerClient{userID, ch}
-	b.Clients[client] = struct{}{}
-	return ch, func() {
-		delete(b.Clients, client)
-		close(ch)
+func newMessage(topic, id, actorID string, v interface{}) (Message, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Message{}, fmt.Errorf("could not marshal %s message: %v", topic, err)
+	}
+
+	return Message{Topic: topic, ID: id, ActorID: actorID, Data: data}, nil
+}
+
+func (b *Broker) close() {
+	close(b.quit)
+	<-b.done
+	if err := b.backend.Close(); err != nil {
+		log.Printf("could not close broker backend: %v\n", err)
 	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/go-redis/redis"
+)
+
+// redisChannel every instance publishes to and subscribes from.
+// Topic filtering happens on each instance's Broker.
+const redisChannel = "nakama:broker"
+
+type redisBrokerBackend struct {
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	messages chan Message
+	quit     chan struct{}
+}
+
+func newRedisBrokerBackend(address string) (*redisBrokerBackend, error) {
+	client := redis.NewClient(&redis.Options{Addr: address})
+	pubsub := client.Subscribe(redisChannel)
+	// Wait for the subscription to be confirmed
+	// so nothing published from now on is missed.
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		client.Close()
+		return nil, fmt.Errorf("could not subscribe to redis: %v", err)
+	}
+
+	b := &redisBrokerBackend{
+		client:   client,
+		pubsub:   pubsub,
+		messages: make(chan Message, 1),
+		quit:     make(chan struct{}),
+	}
+	go b.loop()
+	return b, nil
+}
+
+func (b *redisBrokerBackend) loop() {
+	defer close(b.messages)
+	for m := range b.pubsub.Channel() {
+		var msg Message
+		if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+			log.Printf("could not unmarshal redis message: %v\n", err)
+			continue
+		}
+		select {
+		case b.messages <- msg:
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+func (b *redisBrokerBackend) Publish(msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return b.client.Publish(redisChannel, payload).Err()
+}
+
+func (b *redisBrokerBackend) Messages() <-chan Message {
+	return b.messages
+}
+
+func (b *redisBrokerBackend) Close() error {
+	close(b.quit)
+	if err := b.pubsub.Close(); err != nil {
+		return err
+	}
+
+	return b.client.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// redisTestAddress is REDIS_ADDRESS when set, to test against a real server.
+// Otherwise an in-process stand-in is started.
+func redisTestAddress(t *testing.T) string {
+	t.Helper()
+	if address, ok := os.LookupEnv("REDIS_ADDRESS"); ok {
+		return address
+	}
+
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Skipf("could not start miniredis: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s.Addr()
+}
+
+func newTestRedisBroker(t *testing.T, address string) *Broker {
+	t.Helper()
+	backend, err := newRedisBrokerBackend(address)
+	if err != nil {
+		t.Skipf("redis not available: %v", err)
+	}
+	b := newBroker(backend)
+	t.Cleanup(b.close)
+	return b
+}
+
+func TestRedisBrokerBackendAcrossInstances(t *testing.T) {
+	address := redisTestAddress(t)
+	publisher := newTestRedisBroker(t, address)
+	subscriber := newTestRedisBroker(t, address)
+
+	ch, unsubscribe := subscriber.subscribe("feed:1")
+	defer unsubscribe()
+	own, unsubscribeOwn := publisher.subscribe("feed:1")
+	defer unsubscribeOwn()
+
+	publisher.publish("feed:2", "1", "", "other topic")
+	publisher.publish("feed:1", "2", "3", map[string]string{"content": "hi"})
+
+	for name, ch := range map[string]<-chan Message{"subscriber": ch, "publisher": own} {
+		msg, ok := receive(t, ch)
+		if !ok {
+			t.Fatalf("%s channel closed", name)
+		}
+		if msg.Topic != "feed:1" || msg.ID != "2" || msg.ActorID != "3" || string(msg.Data) != `{"content":"hi"}` {
+			t.Errorf("%s got unexpected message %+v", name, msg)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receive the next message of ch, or fails after a second.
+// ok is false when ch got closed.
+func receive(t *testing.T, ch <-chan Message) (Message, bool) {
+	t.Helper()
+	select {
+	case msg, ok := <-ch:
+		return msg, ok
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+		return Message{}, false
+	}
+}
+
+func TestBrokerConcurrentUse(t *testing.T) {
+	b := newBroker(newMemoryBrokerBackend())
+	defer b.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := "topic:" + strconv.Itoa(i%5)
+			ch, unsubscribe := b.subscribe(topic, "other:"+strconv.Itoa(i))
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for range ch {
+				}
+			}()
+
+			for j := 0; j < 20; j++ {
+				b.publish(topic, strconv.Itoa(j), "", j)
+			}
+			unsubscribe()
+			<-done
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBrokerDelivers(t *testing.T) {
+	b := newBroker(newMemoryBrokerBackend())
+	defer b.close()
+
+	ch, unsubscribe := b.subscribe("a", "b")
+	defer unsubscribe()
+
+	b.publish("c", "1", "", "ignored")
+	b.publish("b", "2", "actor", "hi")
+
+	msg, ok := receive(t, ch)
+	if !ok {
+		t.Fatal("channel closed")
+	}
+	if msg.Topic != "b" || msg.ID != "2" || msg.ActorID != "actor" || string(msg.Data) != `"hi"` {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+func TestBrokerDropsSlowClient(t *testing.T) {
+	b := newBroker(newMemoryBrokerBackend())
+	defer b.close()
+
+	slow, unsubscribe := b.subscribe("topic")
+	defer unsubscribe()
+	marker, unsubscribeMarker := b.subscribe("marker")
+	defer unsubscribeMarker()
+
+	for i := 0; i <= clientBufferSize; i++ {
+		b.publish("topic", strconv.Itoa(i), "", i)
+	}
+	// Messages are handled in order, so once this one arrives
+	// the slow client has been offered all the others.
+	b.publish("marker", "", "", nil)
+	if _, ok := receive(t, marker); !ok {
+		t.Fatal("marker channel closed")
+	}
+
+	for i := 0; i < clientBufferSize; i++ {
+		if _, ok := receive(t, slow); !ok {
+			t.Fatalf("channel closed after %d messages, want %d", i, clientBufferSize)
+		}
+	}
+	if msg, ok := receive(t, slow); ok {
+		t.Fatalf("slow client got %+v, want its channel closed", msg)
+	}
+
+	// The broker keeps working for everyone else.
+	fast, unsubscribeFast := b.subscribe("topic")
+	defer unsubscribeFast()
+	b.publish("topic", "next", "", nil)
+	if msg, ok := receive(t, fast); !ok || msg.ID != "next" {
+		t.Errorf("got %+v, want next message", msg)
+	}
+}
+
+func TestBrokerNothingAfterUnsubscribe(t *testing.T) {
+	b := newBroker(newMemoryBrokerBackend())
+	defer b.close()
+
+	ch, unsubscribe := b.subscribe("topic")
+	b.publish("topic", "1", "", nil)
+	if _, ok := receive(t, ch); !ok {
+		t.Fatal("channel closed before unsubscribe")
+	}
+
+	unsubscribe()
+	if msg, ok := receive(t, ch); ok {
+		t.Fatalf("got %+v after unsubscribe, want channel closed", msg)
+	}
+
+	other, unsubscribeOther := b.subscribe("topic")
+	defer unsubscribeOther()
+	b.publish("topic", "2", "", nil)
+	if _, ok := receive(t, other); !ok {
+		t.Fatal("channel closed")
+	}
+	if msg, ok := <-ch; ok {
+		t.Errorf("got %+v after unsubscribe", msg)
+	}
+
+	// Unsubscribing twice is fine.
+	unsubscribe()
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := newBroker(newMemoryBrokerBackend())
+	ch, unsubscribe := b.subscribe("topic")
+	b.close()
+
+	if msg, ok := receive(t, ch); ok {
+		t.Fatalf("got %+v, want channel closed", msg)
+	}
+	unsubscribe()
+
+	closed, _ := b.subscribe("topic")
+	if _, ok := receive(t, closed); ok {
+		t.Error("subscribing to a closed broker should give a closed channel")
+	}
+}
@@ -1,32 +1,46 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/go-chi/chi"
 )
 
 // Comment model
+// Replies have a ParentCommentID; they can't be replied to themselves.
 type Comment struct {
-	ID         string    `json:"id"`
-	Content    string    `json:"content"`
-	LikesCount int       `json:"likesCount"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UserID     string    `json:"-"`
-	PostID     string    `json:"-"`
-	User       User      `json:"user"`
-	Mine       bool      `json:"mine"`
-	Liked      bool      `json:"liked"`
+	ID              string     `json:"id"`
+	Cursor          string     `json:"cursor,omitempty"`
+	Content         string     `json:"content"`
+	LikesCount      int        `json:"likesCount"`
+	RepliesCount    int        `json:"repliesCount"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	EditedAt        *time.Time `json:"editedAt"`
+	UserID          string     `json:"-"`
+	PostID          string     `json:"postId"`
+	ParentCommentID *string    `json:"parentCommentId"`
+	User            User       `json:"user"`
+	Mine            bool       `json:"mine"`
+	Liked           bool       `json:"liked"`
 }
 
 // CreateCommentInput request body
 type CreateCommentInput struct {
+	Content         string  `json:"content"`
+	ParentCommentID *string `json:"parentCommentId,omitempty"`
+}
+
+// UpdateCommentInput request body
+type UpdateCommentInput struct {
 	Content string `json:"content"`
 }
 
@@ -36,10 +50,73 @@ type ToggleCommentLikePayload struct {
 	LikesCount int  `json:"likesCount"`
 }
 
+// CommentCounters realtime event sent to the post topic
+// when the likes count of one of its comments changes.
+type CommentCounters struct {
+	CommentID  string `json:"commentId"`
+	PostID     string `json:"postId"`
+	LikesCount int    `json:"likesCount"`
+}
+
+// CommentDeletion realtime event sent as "comment_deleted" to the comments topic.
+// Edits go as "comment_updated" with the whole comment.
+type CommentDeletion struct {
+	CommentID       string  `json:"commentId"`
+	PostID          string  `json:"postId"`
+	ParentCommentID *string `json:"parentCommentId"`
+}
+
+const commentContentMaxLength = 256
+
+var (
+	errParentCommentNotFound = errors.New("parent comment not found")
+	errReplyToReply          = errors.New("can't reply to a reply")
+)
+
+func validateCommentContent(content string) string {
+	if content == "" {
+		return "Content required"
+	}
+	if utf8.RuneCountInString(content) > commentContentMaxLength {
+		return fmt.Sprintf("Content too long. Max %d characters", commentContentMaxLength)
+	}
+	return ""
+}
+
 // Validate user input
 func (input *CreateCommentInput) Validate() map[string]string {
-	// TODO: actual validation
-	return nil
+	errs := make(map[string]string)
+
+	input.Content = strings.TrimSpace(input.Content)
+	if err := validateCommentContent(input.Content); err != "" {
+		errs["content"] = err
+	}
+
+	if input.ParentCommentID != nil {
+		parentCommentID := strings.TrimSpace(*input.ParentCommentID)
+		if parentCommentID == "" {
+			errs["parentCommentId"] = "Parent comment ID required"
+		}
+		input.ParentCommentID = &parentCommentID
+	}
+
+	return errs
+}
+
+// Validate user input
+func (input *UpdateCommentInput) Validate() map[string]string {
+	errs := make(map[string]string)
+
+	input.Content = strings.TrimSpace(input.Content)
+	if err := validateCommentContent(input.Content); err != "" {
+		errs["content"] = err
+	}
+
+	return errs
+}
+
+func commentsTopic(postID string) string {
+	return "comments:" + postID
 }
 
 func createComment(w http.ResponseWriter, r *http.Request) {
@@ -56,17 +133,43 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	content := input.Content
+	parentCommentID := input.ParentCommentID
 
 	ctx := r.Context()
 	authUser := ctx.Value(keyAuthUser).(User)
 	postID := chi.URLParam(r, "post_id")
 
 	var comment Comment
+	var counters PostCounters
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if parentCommentID != nil {
+			var isReply bool
+			if err := tx.QueryRow(`
+				SELECT parent_comment_id IS NOT NULL FROM comments
+				WHERE id = $1 AND post_id = $2
+			`, *parentCommentID, postID).Scan(&isReply); err == sql.ErrNoRows {
+				return errParentCommentNotFound
+			} else if err != nil {
+				return err
+			}
+
+			if isReply {
+				return errReplyToReply
+			}
+
+			if _, err := tx.Exec(`
+				UPDATE comments SET replies_count = replies_count + 1
+				WHERE id = $1
+				RETURNING NOTHING
+			`, *parentCommentID); err != nil {
+				return err
+			}
+		}
+
 		if err := tx.QueryRow(`
-			INSERT INTO comments (content, user_id, post_id) VALUES ($1, $2, $3)
+			INSERT INTO comments (content, user_id, post_id, parent_comment_id) VALUES ($1, $2, $3, $4)
 			RETURNING id, created_at
-		`, content, authUser.ID, postID).Scan(&comment.ID, &comment.CreatedAt); err != nil {
+		`, content, authUser.ID, postID, parentCommentID).Scan(&comment.ID, &comment.CreatedAt); err != nil {
 			return err
 		}
 
@@ -78,13 +181,43 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		_, err := tx.Exec(`
+		if err := tx.QueryRow(`
 			UPDATE posts SET comments_count = comments_count + 1
 			WHERE id = $1
-			RETURNING NOTHING
-		`, postID)
-		return err
-	}); err != nil {
+			RETURNING likes_count, comments_count, reposts_count, quotes_count
+		`, postID).Scan(
+			&counters.LikesCount,
+			&counters.CommentsCount,
+			&counters.RepostsCount,
+			&counters.QuotesCount,
+		); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "comment_mention_notifications", commentJobPayload{comment.ID}); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "comment_notifications", commentJobPayload{comment.ID}); err != nil {
+			return err
+		}
+
+		if parentCommentID == nil {
+			return nil
+		}
+
+		return enqueueJob(tx, "comment_reply_notification", commentJobPayload{comment.ID})
+	}); err == errParentCommentNotFound {
+		respondJSON(w, map[string]string{
+			"parentCommentId": "Parent comment not found",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err == errReplyToReply {
+		respondJSON(w, map[string]string{
+			"parentCommentId": "Can't reply to a reply",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not create comment: %v", err))
 		return
 	}
@@ -92,66 +225,111 @@ func createComment(w http.ResponseWriter, r *http.Request) {
 	comment.Content = content
 	comment.UserID = authUser.ID
 	comment.PostID = postID
+	comment.ParentCommentID = parentCommentID
 	comment.User = authUser
 
-	commentsBroker.Notifier <- comment
+	broker.publish(commentsTopic(postID), comment.ID, authUser.ID, comment)
+	counters.PostID = postID
+	broker.publish(postTopic(postID), "", authUser.ID, counters)
 
 	comment.Mine = true
 
-	go commentMentionNotificationFanout(comment)
-	go commentNotificationFanout(comment)
+	jobWorkers.notify()
 
 	respondJSON(w, comment, http.StatusCreated)
 }
 
-// TODO: add pagination
 func getComments(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+	authUserID, _ := ctx.Value(keyAuthUserID).(string)
 	postID := chi.URLParam(r, "post_id")
 
 	if a := r.Header.Get("Accept"); strings.Contains(a, "text/event-stream") {
-		f, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			return
-		}
+		streamSSE(w, r, sseStream{
+			topic:       commentsTopic(postID),
+			skipActorID: authUserID,
+			replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+				return commentsSince(ctx, postID, authUserID, lastEventID)
+			},
+		})
+		return
+	}
 
-		h := w.Header()
-		h.Set("Cache-Control", "no-cache")
-		h.Set("Connection", "keep-alive")
-		h.Set("Content-Type", "text/event-stream")
-
-		ch, unsubscribe := commentsBroker.subscribe(authUserID, postID)
-		defer unsubscribe()
-
-		for {
-			select {
-			case <-w.(http.CloseNotifier).CloseNotify():
-				return
-			case <-time.After(time.Second * 15):
-				fmt.Fprint(w, "ping: \n\n")
-				f.Flush()
-			case comment := <-ch:
-				if b, err := json.Marshal(comment); err != nil {
-					fmt.Fprintf(w, "error: %v\n\n", err)
-				} else {
-					fmt.Fprintf(w, "data: %s\n\n", b)
-				}
-				f.Flush()
-			}
-		}
+	page, errs := parsePageParams(r.URL.Query())
+	if errs == nil {
+		errs = page.cursorErrs()
+	}
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	comments, err := getCommentsWhere(ctx, `comments.post_id = $1
+		AND comments.parent_comment_id IS NULL`, postID, page)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondJSON(w, comments, http.StatusOK)
+}
+
+// getCommentReplies returns the replies of a comment, newest first like comments.
+func getCommentReplies(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs == nil {
+		errs = page.cursorErrs()
+	}
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	commentID := chi.URLParam(r, "comment_id")
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM comments WHERE id = $1
+	)`, commentID).Scan(&exists); err != nil {
+		respondError(w, fmt.Errorf("could not query comment existence: %v", err))
+		return
+	}
+
+	if !exists {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	replies, err := getCommentsWhere(ctx, "comments.parent_comment_id = $1", commentID, page)
+	if err != nil {
+		respondError(w, err)
+		return
 	}
 
+	respondJSON(w, replies, http.StatusOK)
+}
+
+// getCommentsWhere returns a page of comments sorted newest first.
+// where can use $1 as the given id.
+func getCommentsWhere(ctx context.Context, where, id string, page PageParams) (Page, error) {
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+
 	query := `
 		SELECT
 			comments.id,
 			comments.content,
 			comments.likes_count,
+			comments.replies_count,
 			comments.created_at,
+			comments.edited_at,
+			comments.post_id,
+			comments.parent_comment_id,
 			users.username,
 			users.avatar_url`
-	args := []interface{}{postID}
+	args := []interface{}{id}
 	if authenticated {
 		query += `,
 			comments.user_id = $2 AS mine,
@@ -167,17 +345,20 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 			ON likes.user_id = $2 AND likes.comment_id = comments.id`
 	}
 	query += `
-		WHERE comments.post_id = $1
-		ORDER BY comments.created_at DESC`
+		WHERE ` + where
+	conds, args := page.cursorConds("comments.created_at", "comments.id", args)
+	query += conds
+	query += page.orderBy(true, "comments.created_at DESC", "comments.id DESC")
+	limit, args := page.limit(args)
+	query += limit
 
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		respondError(w, fmt.Errorf("could not query comments: %v", err))
-		return
+		return Page{}, fmt.Errorf("could not query comments: %v", err)
 	}
 	defer rows.Close()
 
-	comments := make([]Comment, 0)
+	comments := make([]Comment, 0, page.Limit+1)
 	for rows.Next() {
 		var user User
 		var comment Comment
@@ -185,7 +366,11 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 			&comment.ID,
 			&comment.Content,
 			&comment.LikesCount,
+			&comment.RepliesCount,
 			&comment.CreatedAt,
+			&comment.EditedAt,
+			&comment.PostID,
+			&comment.ParentCommentID,
 			&user.Username,
 			&user.AvatarURL,
 		}
@@ -197,19 +382,321 @@ func getComments(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err = rows.Scan(dest...); err != nil {
-			respondError(w, fmt.Errorf("could not scan comment: %v", err))
-			return
+			return Page{}, fmt.Errorf("could not scan comment: %v", err)
 		}
 
+		comment.Cursor = encodeCursor(comment.CreatedAt, comment.ID)
 		comment.User = user
 		comments = append(comments, comment)
 	}
 	if err = rows.Err(); err != nil {
-		respondError(w, fmt.Errorf("could not iterate over comments: %v", err))
+		return Page{}, fmt.Errorf("could not iterate over comments: %v", err)
+	}
+
+	n, hasMore := page.trim(true, comments)
+	comments = comments[:n]
+
+	return Page{comments, hasMore}, nil
+}
+
+// commentsSince returns the comments made on the post after lastID,
+// skipping the ones from skipUserID.
+func commentsSince(ctx context.Context, postID, skipUserID, lastID string) ([]Message, error) {
+	query := `
+		SELECT
+			comments.id,
+			comments.content,
+			comments.likes_count,
+			comments.replies_count,
+			comments.created_at,
+			comments.edited_at,
+			comments.parent_comment_id,
+			users.username,
+			users.avatar_url
+		FROM comments
+		INNER JOIN users ON comments.user_id = users.id
+		WHERE comments.post_id = $1
+			AND comments.id > $2`
+	args := []interface{}{postID, lastID, sseReplayLimit}
+	if skipUserID != "" {
+		query += `
+			AND comments.user_id != $4`
+		args = append(args, skipUserID)
+	}
+	query += `
+		ORDER BY comments.id
+		LIMIT $3`
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not query comments since: %v", err)
+	}
+	defer rows.Close()
+
+	msgs := make([]Message, 0)
+	for rows.Next() {
+		var comment Comment
+		if err = rows.Scan(
+			&comment.ID,
+			&comment.Content,
+			&comment.LikesCount,
+			&comment.RepliesCount,
+			&comment.CreatedAt,
+			&comment.EditedAt,
+			&comment.ParentCommentID,
+			&comment.User.Username,
+			&comment.User.AvatarURL,
+		); err != nil {
+			return nil, fmt.Errorf("could not scan comment: %v", err)
+		}
+
+		comment.PostID = postID
+		msg, err := newMessage(commentsTopic(postID), comment.ID, "", comment)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over comments: %v", err)
+	}
+
+	return msgs, nil
+}
+
+// updateComment changes the content of the auth user's comment.
+// Users mentioned for the first time get notified.
+func updateComment(w http.ResponseWriter, r *http.Request) {
+	var input UpdateCommentInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer r.Body.Close()
 
-	respondJSON(w, comments, http.StatusOK)
+	if errs := input.Validate(); len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	content := input.Content
+
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	commentID := chi.URLParam(r, "comment_id")
+
+	var comment Comment
+	var changed bool
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRow(`
+			SELECT user_id, post_id, content
+			FROM comments WHERE id = $1
+		`, commentID).Scan(&comment.UserID, &comment.PostID, &comment.Content); err != nil {
+			return err
+		}
+
+		if comment.UserID != authUser.ID {
+			return errForbidden
+		}
+
+		changed = comment.Content != content
+
+		if err := tx.QueryRow(`
+			UPDATE comments SET
+				content = $2,
+				edited_at = CASE WHEN $4 THEN now() ELSE edited_at END
+			WHERE id = $1
+			RETURNING
+				likes_count,
+				replies_count,
+				parent_comment_id,
+				created_at,
+				edited_at,
+				EXISTS (
+					SELECT 1 FROM comment_likes
+					WHERE user_id = $3 AND comment_id = $1
+				)
+		`, commentID, content, authUser.ID, changed).Scan(
+			&comment.LikesCount,
+			&comment.RepliesCount,
+			&comment.ParentCommentID,
+			&comment.CreatedAt,
+			&comment.EditedAt,
+			&comment.Liked,
+		); err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+
+		return enqueueJob(tx, "comment_mention_notifications", commentJobPayload{commentID})
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errForbidden {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not update comment: %v", err))
+		return
+	}
+
+	comment.ID = commentID
+	comment.Content = content
+	comment.User = authUser
+
+	if changed {
+		// Whether the author liked it is nobody else's business.
+		updated := comment
+		updated.Liked = false
+		broker.publishEvent(commentsTopic(comment.PostID), "comment_updated", authUser.ID, updated)
+
+		jobWorkers.notify()
+	}
+
+	comment.Mine = true
+
+	respondJSON(w, comment, http.StatusOK)
+}
+
+// deleteComment removes a comment along with its likes, notifications and replies.
+// Either the comment author or the post author can do it.
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	commentID := chi.URLParam(r, "comment_id")
+
+	var postID string
+	var parentCommentID *string
+	var counters PostCounters
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var userID, postUserID string
+		if err := tx.QueryRow(`
+			SELECT comments.user_id, comments.post_id, comments.parent_comment_id, posts.user_id
+			FROM comments
+			INNER JOIN posts ON comments.post_id = posts.id
+			WHERE comments.id = $1
+		`, commentID).Scan(&userID, &postID, &parentCommentID, &postUserID); err != nil {
+			return err
+		}
+
+		if authUserID != userID && authUserID != postUserID {
+			return errForbidden
+		}
+
+		// The comment and its replies; replies have none.
+		commentsWhere := "id = $1 OR parent_comment_id = $1"
+
+		if _, err := tx.Exec(`
+			DELETE FROM notifications
+			WHERE object_id IN (SELECT id FROM comments WHERE `+commentsWhere+`)
+				AND verb IN ('comment', 'comment_mention', 'comment_reply')
+		`, commentID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM comment_likes
+			WHERE comment_id IN (SELECT id FROM comments WHERE `+commentsWhere+`)
+		`, commentID); err != nil {
+			return err
+		}
+
+		result, err := tx.Exec("DELETE FROM comments WHERE "+commentsWhere, commentID)
+		if err != nil {
+			return err
+		}
+
+		deletedCount, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if parentCommentID != nil {
+			if _, err := tx.Exec(`
+				UPDATE comments SET replies_count = replies_count - 1
+				WHERE id = $1
+				RETURNING NOTHING
+			`, *parentCommentID); err != nil {
+				return err
+			}
+		}
+
+		return tx.QueryRow(`
+			UPDATE posts SET comments_count = comments_count - $2
+			WHERE id = $1
+			RETURNING likes_count, comments_count, reposts_count, quotes_count
+		`, postID, deletedCount).Scan(
+			&counters.LikesCount,
+			&counters.CommentsCount,
+			&counters.RepostsCount,
+			&counters.QuotesCount,
+		)
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errForbidden {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not delete comment: %v", err))
+		return
+	}
+
+	broker.publishEvent(commentsTopic(postID), "comment_deleted", authUserID, CommentDeletion{commentID, postID, parentCommentID})
+	counters.PostID = postID
+	broker.publish(postTopic(postID), "", authUserID, counters)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commentByID loads a comment along with its author.
+func commentByID(ctx context.Context, commentID string) (Comment, error) {
+	var comment Comment
+	if err := db.QueryRowContext(ctx, `
+		SELECT
+			comments.content,
+			comments.likes_count,
+			comments.created_at,
+			comments.edited_at,
+			comments.user_id,
+			comments.post_id,
+			comments.parent_comment_id,
+			comments.replies_count,
+			users.username,
+			users.avatar_url
+		FROM comments
+		INNER JOIN users ON comments.user_id = users.id
+		WHERE comments.id = $1
+	`, commentID).Scan(
+		&comment.Content,
+		&comment.LikesCount,
+		&comment.CreatedAt,
+		&comment.EditedAt,
+		&comment.UserID,
+		&comment.PostID,
+		&comment.ParentCommentID,
+		&comment.RepliesCount,
+		&comment.User.Username,
+		&comment.User.AvatarURL,
+	); err != nil {
+		return comment, err
+	}
+
+	comment.ID = commentID
+	comment.User.ID = comment.UserID
+	return comment, nil
 }
 
 func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
@@ -219,6 +706,7 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 
 	var liked bool
 	var likesCount int
+	var postID string
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM comment_likes
@@ -239,8 +727,8 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 			return tx.QueryRow(`
 				UPDATE comments SET likes_count = likes_count - 1
 				WHERE id = $1
-				RETURNING likes_count
-			`, commentID).Scan(&likesCount)
+				RETURNING likes_count, post_id
+			`, commentID).Scan(&likesCount, &postID)
 		}
 
 		if _, err := tx.Exec(`
@@ -253,8 +741,8 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 		return tx.QueryRow(`
 			UPDATE comments SET likes_count = likes_count + 1
 			WHERE id = $1
-			RETURNING likes_count
-		`, commentID).Scan(&likesCount)
+			RETURNING likes_count, post_id
+		`, commentID).Scan(&likesCount, &postID)
 	}); err != nil {
 		respondError(w, fmt.Errorf("could not toggle comment like: %v", err))
 		return
@@ -262,5 +750,7 @@ func toggleCommentLike(w http.ResponseWriter, r *http.Request) {
 
 	liked = !liked
 
+	broker.publish(postTopic(postID), "", authUserID, CommentCounters{commentID, postID, likesCount})
+
 	respondJSON(w, ToggleCommentLikePayload{liked, likesCount}, http.StatusOK)
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateCommentInputValidate(t *testing.T) {
+	tooLong := fmt.Sprintf("Content too long. Max %d characters", commentContentMaxLength)
+	tests := []struct {
+		name  string
+		input CreateCommentInput
+		want  map[string]string
+	}{
+		{"valid", CreateCommentInput{Content: "nice"}, map[string]string{}},
+		{"reply", CreateCommentInput{Content: "nice", ParentCommentID: strPtr("1")}, map[string]string{}},
+		{"empty content", CreateCommentInput{Content: ""}, map[string]string{"content": "Content required"}},
+		{"blank content", CreateCommentInput{Content: "  "}, map[string]string{"content": "Content required"}},
+		{"content max length", CreateCommentInput{Content: strings.Repeat("a", commentContentMaxLength)}, map[string]string{}},
+		{"content max length in runes", CreateCommentInput{Content: strings.Repeat("ñ", commentContentMaxLength)}, map[string]string{}},
+		{"content too long", CreateCommentInput{Content: strings.Repeat("a", commentContentMaxLength+1)}, map[string]string{"content": tooLong}},
+		{"blank parent", CreateCommentInput{Content: "nice", ParentCommentID: strPtr(" ")}, map[string]string{"parentCommentId": "Parent comment ID required"}},
+		{"every field", CreateCommentInput{Content: "", ParentCommentID: strPtr("")},
+			map[string]string{"content": "Content required", "parentCommentId": "Parent comment ID required"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.Validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCommentInputValidateTrims(t *testing.T) {
+	input := CreateCommentInput{Content: " nice\n", ParentCommentID: strPtr(" 1 ")}
+	if errs := input.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate() = %v, want no errors", errs)
+	}
+	if input.Content != "nice" || *input.ParentCommentID != "1" {
+		t.Errorf("input not trimmed: %q, %q", input.Content, *input.ParentCommentID)
+	}
+}
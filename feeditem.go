@@ -1,60 +1,52 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// feedBackfillSize is how many of the latest posts of a user
+// get added to the feed of a new follower.
+const feedBackfillSize = 25
+
 // FeedItem model
+// Cursor is an opaque token to pass as before or after when paginating the feed.
+// RepostedBy is set when the post got into the feed by a repost of a followed user.
 type FeedItem struct {
-	ID     string `json:"id"`
-	UserID string `json:"-"`
-	PostID string `json:"-"`
-	Post   Post   `json:"post"`
+	ID         string     `json:"id"`
+	Cursor     string     `json:"cursor"`
+	UserID     string     `json:"-"`
+	PostID     string     `json:"-"`
+	Post       Post       `json:"post"`
+	RepostedBy *User      `json:"repostedBy,omitempty"`
+	RepostedAt *time.Time `json:"repostedAt,omitempty"`
 }
 
-func getFeed(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	authUserID := ctx.Value(keyAuthUserID).(string)
+// sortTime is when the post got into the feed: when it was created,
+// or when it was reposted.
+func (fi FeedItem) sortTime() time.Time {
+	if fi.RepostedAt != nil {
+		return *fi.RepostedAt
+	}
+	return fi.Post.CreatedAt
+}
 
-	if a := r.Header.Get("Accept"); strings.Contains(a, "text/event-stream") {
-		f, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			return
-		}
+func feedTopic(userID string) string {
+	return "feed:" + userID
+}
 
-		h := w.Header()
-		h.Set("Cache-Control", "no-cache")
-		h.Set("Connection", "keep-alive")
-		h.Set("Content-Type", "text/event-stream")
-
-		ch, unsubscribe := feedBroker.subscribe(authUserID)
-		defer unsubscribe()
-
-		for {
-			select {
-			case <-w.(http.CloseNotifier).CloseNotify():
-				return
-			case <-time.After(time.Second * 15):
-				fmt.Fprint(w, "ping: \n\n")
-				f.Flush()
-			case feedItem := <-ch:
-				if b, err := json.Marshal(feedItem); err != nil {
-					fmt.Fprintf(w, "error: %v\n\n", err)
-				} else {
-					fmt.Fprintf(w, "data: %s\n\n", b)
-				}
-				f.Flush()
-			}
-		}
-	}
+// fanoutThreshold is the followers count from which the posts of a user
+// are not copied into every follower's feed but merged into it on read.
+// Zero copies them always.
+var fanoutThreshold int
 
-	query := `
+const feedSelect = `
 		SELECT
 			feed.id,
 			posts.id,
@@ -62,32 +54,123 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 			posts.spoiler_of,
 			posts.likes_count,
 			posts.comments_count,
+			posts.reposts_count,
+			posts.quotes_count,
+			posts.quote_of_id,
 			posts.created_at,
+			posts.edited_at,
 			users.username,
 			users.avatar_url,
 			posts.user_id = $1 AS mine,
 			likes.user_id IS NOT NULL AS liked,
-			subscriptions.user_id IS NOT NULL AS subscribed
-		FROM feed
+			reposts.user_id IS NOT NULL AS reposted,
+			subscriptions.user_id IS NOT NULL AS subscribed,
+			feed.reposted_at,
+			reposters.username,
+			reposters.avatar_url`
+
+const feedJoins = `
 		INNER JOIN posts ON feed.post_id = posts.id
 		INNER JOIN users ON posts.user_id = users.id
 		LEFT JOIN post_likes AS likes
 			ON likes.user_id = $1
 			AND likes.post_id = posts.id
+		LEFT JOIN reposts
+			ON reposts.user_id = $1
+			AND reposts.post_id = posts.id
 		LEFT JOIN subscriptions
 			ON subscriptions.user_id = $1
 			AND subscriptions.post_id = posts.id
-		WHERE feed.user_id = $1`
+		LEFT JOIN users AS reposters ON feed.reposted_by_id = reposters.id`
+
+const feedQuery = feedSelect + `
+		FROM feed` + feedJoins
+
+// mergedFeedQuery reads the feed of user $1:
+// the feed items plus the posts of followed users fanned out on read.
+// Those use the post id as feed item id;
+// being serial too, cursors work the same for both.
+// where, orderBy and limit apply to each branch before merging them,
+// with {sorted_at} and {id} replaced by its sort time and id columns,
+// so each one reads at most limit rows through its index.
+// Sort the result by feed.sorted_at and feed.id the same way.
+func mergedFeedQuery(where, orderBy, limit string) string {
+	feedCols := strings.NewReplacer("{sorted_at}", "sorted_at", "{id}", "id")
+	postsCols := strings.NewReplacer("{sorted_at}", "posts.created_at", "{id}", "posts.id")
+	return feedSelect + `
+		FROM (
+			(
+				SELECT id, user_id, post_id, reposted_by_id, reposted_at, sorted_at FROM feed
+				WHERE user_id = $1` + feedCols.Replace(where) + feedCols.Replace(orderBy) + limit + `
+			)
+			UNION ALL
+			(
+				SELECT posts.id, follows.follower_id, posts.id, NULL::INT, NULL::TIMESTAMPTZ, posts.created_at FROM posts
+				INNER JOIN follows ON follows.following_id = posts.user_id
+				WHERE follows.follower_id = $1
+					AND posts.fanout_on_read
+					AND NOT EXISTS (
+						SELECT 1 FROM feed
+						WHERE feed.user_id = $1 AND feed.post_id = posts.id
+					)` + postsCols.Replace(where) + postsCols.Replace(orderBy) + limit + `
+			)
+		) AS feed` + feedJoins
+}
+
+func getFeed(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	if a := r.Header.Get("Accept"); strings.Contains(a, "text/event-stream") {
+		streamSSE(w, r, sseStream{
+			topic: feedTopic(authUserID),
+			replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+				return feedSince(ctx, authUserID, lastEventID)
+			},
+		})
+		return
+	}
+
+	page, errs := parsePageParams(r.URL.Query())
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
 	args := []interface{}{authUserID}
 
-	if before := strings.TrimSpace(r.URL.Query().Get("before")); before != "" {
-		query += " AND feed.id < $2"
-		args = append(args, before)
+	// Sorted by post creation time, or repost time for reposts,
+	// with the feed id breaking ties, so the cursor has to carry both.
+	var where string
+	if page.Before != "" {
+		createdAt, id, err := decodeCursor(page.Before)
+		if err != nil {
+			respondJSON(w, map[string]string{
+				"before": "Invalid cursor",
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+		args = append(args, createdAt, id)
+		where += fmt.Sprintf(`
+					AND ({sorted_at}, {id}) < ($%d, $%d)`, len(args)-1, len(args))
+	}
+	if page.After != "" {
+		createdAt, id, err := decodeCursor(page.After)
+		if err != nil {
+			respondJSON(w, map[string]string{
+				"after": "Invalid cursor",
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+		args = append(args, createdAt, id)
+		where += fmt.Sprintf(`
+					AND ({sorted_at}, {id}) > ($%d, $%d)`, len(args)-1, len(args))
 	}
 
-	query += `
-		ORDER BY posts.created_at DESC
-		LIMIT 25`
+	orderBy := page.orderBy(true, "{sorted_at} DESC", "{id} DESC")
+	limit, args := page.limit(args)
+	query := mergedFeedQuery(where, orderBy, limit) +
+		strings.NewReplacer("{sorted_at}", "feed.sorted_at", "{id}", "feed.id").Replace(orderBy) + limit
 
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -96,66 +179,418 @@ func getFeed(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
+	feed, err := scanFeed(rows)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	n, hasMore := page.trim(true, feed)
+	feed = feed[:n]
+
+	if err = withFeedMedia(ctx, feed); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondJSON(w, Page{feed, hasMore}, http.StatusOK)
+}
+
+// feedSince returns the feed items added to the user's feed after lastID,
+// merged posts included.
+func feedSince(ctx context.Context, userID, lastID string) ([]Message, error) {
+	rows, err := db.QueryContext(ctx, mergedFeedQuery(`
+					AND {id} > $2`, `
+				ORDER BY {id}`, `
+				LIMIT $3`)+`
+		WHERE posts.user_id != $1
+		ORDER BY feed.id
+		LIMIT $3`, userID, lastID, sseReplayLimit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query feed since: %v", err)
+	}
+	defer rows.Close()
+
+	feed, err := scanFeed(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = withFeedMedia(ctx, feed); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Message, 0, len(feed))
+	for _, feedItem := range feed {
+		msg, err := newMessage(feedTopic(userID), feedItem.ID, "", feedItem)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func scanFeed(rows *sql.Rows) ([]FeedItem, error) {
 	feed := make([]FeedItem, 0)
 	for rows.Next() {
 		var user User
 		var post Post
 		var feedItem FeedItem
-		if err = rows.Scan(
+		var reposterUsername sql.NullString
+		var reposterAvatarURL *string
+		if err := rows.Scan(
 			&feedItem.ID,
 			&post.ID,
 			&post.Content,
 			&post.SpoilerOf,
 			&post.LikesCount,
 			&post.CommentsCount,
+			&post.RepostsCount,
+			&post.QuotesCount,
+			&post.QuoteOfID,
 			&post.CreatedAt,
+			&post.EditedAt,
 			&user.Username,
 			&user.AvatarURL,
 			&post.Mine,
 			&post.Liked,
+			&post.Reposted,
 			&post.Subscribed,
+			&feedItem.RepostedAt,
+			&reposterUsername,
+			&reposterAvatarURL,
 		); err != nil {
-			respondError(w, fmt.Errorf("could not scan feed item: %v", err))
-			return
+			return nil, fmt.Errorf("could not scan feed item: %v", err)
 		}
 
 		post.User = &user
+		if reposterUsername.Valid {
+			feedItem.RepostedBy = &User{
+				Username:  reposterUsername.String,
+				AvatarURL: reposterAvatarURL,
+			}
+		}
+		feedItem.Cursor = encodeCursor(feedItem.sortTime(), feedItem.ID)
 		feedItem.Post = post
 		feed = append(feed, feedItem)
 	}
-	if err = rows.Err(); err != nil {
-		respondError(w, fmt.Errorf("could not iterate over feed: %v", err))
-		return
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over feed: %v", err)
 	}
 
-	respondJSON(w, feed, http.StatusOK)
+	return feed, nil
 }
 
-func feedFanout(post Post) {
+// withFeedMedia sets the media of the posts in the feed.
+func withFeedMedia(ctx context.Context, feed []FeedItem) error {
+	posts := make([]*Post, len(feed))
+	for i := range feed {
+		posts[i] = &feed[i].Post
+	}
+	return withPostsMedia(ctx, posts)
+}
+
+// feedFanout adds the post to the feed of the author's followers and pushes it live.
+// Followers that already have it are skipped so the job can be retried.
+// Posts of users with more followers than fanoutThreshold
+// are flagged to be merged into the feeds on read and just pushed live.
+func feedFanout(ctx context.Context, post Post) error {
 	post.Mine = false
 	post.Subscribed = false
 
-	rows, err := db.Query(`
-		INSERT INTO feed (user_id, post_id)
-		SELECT follower_id, $1 FROM follows WHERE following_id = $2
+	if fanoutThreshold > 0 {
+		var fanoutOnRead bool
+		if err := db.QueryRowContext(ctx, `
+			UPDATE posts SET fanout_on_read = true
+			WHERE id = $1
+				AND (SELECT followers_count FROM users WHERE id = $2) >= $3
+			RETURNING true
+		`, post.ID, post.UserID, fanoutThreshold).Scan(&fanoutOnRead); err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("could not check fanout on read: %v", err)
+		}
+
+		if fanoutOnRead {
+			return feedPublishMerged(ctx, post)
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		INSERT INTO feed (user_id, post_id, sorted_at)
+		SELECT follower_id, $1, $3 FROM follows
+		WHERE following_id = $2
+			AND NOT EXISTS (
+				SELECT 1 FROM feed
+				WHERE feed.user_id = follows.follower_id AND feed.post_id = $1
+			)
 		RETURNING id, user_id
-	`, post.ID, post.UserID)
+	`, post.ID, post.UserID, post.CreatedAt)
 	if err != nil {
-		log.Printf("could not query feed fanout: %v\n", err)
-		return
+		return fmt.Errorf("could not query feed fanout: %v", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var feedItem FeedItem
 		if err = rows.Scan(&feedItem.ID, &feedItem.UserID); err != nil {
-			log.Printf("could not scan feed fanout: %v\n", err)
-			return
+			return fmt.Errorf("could not scan feed fanout: %v", err)
 		}
+		feedItem.Cursor = encodeCursor(post.CreatedAt, feedItem.ID)
 		feedItem.Post = post
-		feedBroker.Notifier <- feedItem
+		broker.publish(feedTopic(feedItem.UserID), feedItem.ID, post.UserID, feedItem)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not iterate over feed fanout: %v", err)
+	}
+
+	return nil
+}
+
+// feedPublishMerged pushes a post fanned out on read to the author's followers.
+// The feed item is the one getFeed merges, with the post id as id,
+// so feedSince replays it too.
+func feedPublishMerged(ctx context.Context, post Post) error {
+	followerIDs, err := followerIDs(ctx, post.UserID)
+	if err != nil {
+		return err
+	}
+
+	feedItem := FeedItem{
+		ID:     post.ID,
+		Cursor: encodeCursor(post.CreatedAt, post.ID),
+		Post:   post,
+	}
+	for _, followerID := range followerIDs {
+		broker.publish(feedTopic(followerID), feedItem.ID, post.UserID, feedItem)
+	}
+
+	return nil
+}
+
+// feedPublishMergedDeletion tells the author's followers a post fanned out on read is gone.
+// Having no feed items, deletePost can't reach them otherwise.
+func feedPublishMergedDeletion(ctx context.Context, userID, postID string) error {
+	followerIDs, err := followerIDs(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	deletion := PostDeletion{postID}
+	for _, followerID := range followerIDs {
+		broker.publishEvent(feedTopic(followerID), "post_deleted", userID, deletion)
+	}
+
+	return nil
+}
+
+func followerIDs(ctx context.Context, userID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT follower_id FROM follows WHERE following_id = $1", userID)
+	if err != nil {
+		return nil, fmt.Errorf("could not query followers: %v", err)
+	}
+	defer rows.Close()
+
+	var followerIDs []string
+	for rows.Next() {
+		var followerID string
+		if err = rows.Scan(&followerID); err != nil {
+			return nil, fmt.Errorf("could not scan follower: %v", err)
+		}
+		followerIDs = append(followerIDs, followerID)
 	}
 	if err = rows.Err(); err != nil {
-		log.Printf("could not iterate over feed fanout: %v\n", err)
+		return nil, fmt.Errorf("could not iterate over followers: %v", err)
+	}
+
+	return followerIDs, nil
+}
+
+// feedBackfill adds the latest posts of the followed user to the follower's feed
+// and pushes them live. Posts fanned out on read are left out, getFeed merges those.
+func feedBackfill(ctx context.Context, followerID, followingID string) error {
+	// Checking the follow still exists
+	// keeps a quick follow and unfollow from leaving posts behind.
+	rows, err := db.QueryContext(ctx, `
+		INSERT INTO feed (user_id, post_id, sorted_at)
+		SELECT $1, posts.id, posts.created_at FROM posts
+		WHERE posts.user_id = $2
+			AND NOT posts.fanout_on_read
+			AND EXISTS (
+				SELECT 1 FROM follows
+				WHERE follower_id = $1 AND following_id = $2
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM feed
+				WHERE feed.user_id = $1 AND feed.post_id = posts.id
+			)
+		ORDER BY posts.created_at DESC
+		LIMIT $3
+		RETURNING id
+	`, followerID, followingID, feedBackfillSize)
+	if err != nil {
+		return fmt.Errorf("could not insert feed backfill: %v", err)
 	}
+	defer rows.Close()
+
+	feedItemIDs := make([]string, 0, feedBackfillSize)
+	for rows.Next() {
+		var feedItemID string
+		if err = rows.Scan(&feedItemID); err != nil {
+			return fmt.Errorf("could not scan feed backfill: %v", err)
+		}
+		feedItemIDs = append(feedItemIDs, feedItemID)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not iterate over feed backfill: %v", err)
+	}
+
+	if len(feedItemIDs) == 0 {
+		return nil
+	}
+
+	rows, err = db.QueryContext(ctx, feedQuery+`
+		WHERE feed.user_id = $1
+			AND feed.id = ANY($2)
+		ORDER BY feed.sorted_at, feed.id
+	`, followerID, pq.Array(feedItemIDs))
+	if err != nil {
+		return fmt.Errorf("could not query feed backfill: %v", err)
+	}
+	defer rows.Close()
+
+	feed, err := scanFeed(rows)
+	if err != nil {
+		return err
+	}
+
+	if err = withFeedMedia(ctx, feed); err != nil {
+		return err
+	}
+
+	for _, feedItem := range feed {
+		broker.publish(feedTopic(followerID), feedItem.ID, followingID, feedItem)
+	}
+
+	return nil
+}
+
+// feedPrune removes the posts and reposts of the unfollowed user from the follower's feed.
+func feedPrune(ctx context.Context, followerID, followingID string) error {
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM feed
+		WHERE user_id = $1
+			AND (
+				(reposted_by_id IS NULL AND post_id IN (SELECT id FROM posts WHERE user_id = $2))
+				OR reposted_by_id = $2
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM follows
+				WHERE follower_id = $1 AND following_id = $2
+			)
+	`, followerID, followingID); err != nil {
+		return fmt.Errorf("could not prune feed: %v", err)
+	}
+
+	return nil
+}
+
+// repostFanout adds the post reposted by the user to the feed of their followers
+// and pushes it live. Followers that already have the post, from its author
+// or from another repost, are skipped. Reposts are always copied,
+// no matter the followers count of the reposter.
+func repostFanout(ctx context.Context, userID, postID string) error {
+	rows, err := db.QueryContext(ctx, `
+		INSERT INTO feed (user_id, post_id, reposted_by_id, reposted_at, sorted_at)
+		SELECT follows.follower_id, reposts.post_id, reposts.user_id, reposts.created_at, reposts.created_at
+		FROM reposts
+		INNER JOIN follows ON follows.following_id = reposts.user_id
+		INNER JOIN posts ON posts.id = reposts.post_id
+		WHERE reposts.user_id = $1
+			AND reposts.post_id = $2
+			AND follows.follower_id != posts.user_id
+			AND NOT EXISTS (
+				SELECT 1 FROM feed
+				WHERE feed.user_id = follows.follower_id AND feed.post_id = $2
+			)
+		RETURNING id, user_id
+	`, userID, postID)
+	if err != nil {
+		return fmt.Errorf("could not insert repost fanout: %v", err)
+	}
+	defer rows.Close()
+
+	followerIDs := map[string]string{}
+	feedItemIDs := []string{}
+	for rows.Next() {
+		var feedItemID, followerID string
+		if err = rows.Scan(&feedItemID, &followerID); err != nil {
+			return fmt.Errorf("could not scan repost fanout: %v", err)
+		}
+		followerIDs[feedItemID] = followerID
+		feedItemIDs = append(feedItemIDs, feedItemID)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not iterate over repost fanout: %v", err)
+	}
+
+	if len(feedItemIDs) == 0 {
+		return nil
+	}
+
+	// Liked, reposted and subscribed are relative to each follower,
+	// same as in feedFanout those are left false.
+	rows, err = db.QueryContext(ctx, feedQuery+`
+		WHERE feed.id = ANY($2)
+	`, "0", pq.Array(feedItemIDs))
+	if err != nil {
+		return fmt.Errorf("could not query repost fanout: %v", err)
+	}
+	defer rows.Close()
+
+	feed, err := scanFeed(rows)
+	if err != nil {
+		return err
+	}
+
+	if err = withFeedMedia(ctx, feed); err != nil {
+		return err
+	}
+
+	for _, feedItem := range feed {
+		broker.publish(feedTopic(followerIDs[feedItem.ID]), feedItem.ID, userID, feedItem)
+	}
+
+	return nil
+}
+
+// repostPrune removes the post from the feeds it got into by the user's repost,
+// unless it was reposted again.
+func repostPrune(ctx context.Context, userID, postID string) error {
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM feed
+		WHERE reposted_by_id = $1
+			AND post_id = $2
+			AND NOT EXISTS (
+				SELECT 1 FROM reposts
+				WHERE user_id = $1 AND post_id = $2
+			)
+		RETURNING user_id
+	`, userID, postID)
+	if err != nil {
+		return fmt.Errorf("could not prune repost: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var followerID string
+		if err = rows.Scan(&followerID); err != nil {
+			return fmt.Errorf("could not scan pruned repost: %v", err)
+		}
+		broker.publishEvent(feedTopic(followerID), "post_deleted", userID, PostDeletion{PostID: postID})
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not iterate over pruned repost: %v", err)
+	}
+
+	return nil
 }
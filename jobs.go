@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+const (
+	jobPollInterval = time.Second * 5
+	// jobLockTimeout is how long a claimed job stays hidden from other workers.
+	// Jobs of a crashed worker are picked up again after it.
+	jobLockTimeout = time.Minute * 5
+	jobMaxBackoff  = time.Hour
+)
+
+// Job is a unit of background work stored in the jobs table.
+type Job struct {
+	ID          string
+	Kind        string
+	Payload     json.RawMessage
+	Attempts    int
+	MaxAttempts int
+}
+
+type jobHandler func(ctx context.Context, payload json.RawMessage) error
+
+type postJobPayload struct {
+	PostID string `json:"postId"`
+}
+
+type commentJobPayload struct {
+	CommentID string `json:"commentId"`
+}
+
+type followJobPayload struct {
+	FollowerID  string `json:"followerId"`
+	FollowingID string `json:"followingId"`
+}
+
+type repostJobPayload struct {
+	UserID string `json:"userId"`
+	PostID string `json:"postId"`
+}
+
+// postDeletionJobPayload is about a post already deleted, so it carries its author.
+type postDeletionJobPayload struct {
+	UserID string `json:"userId"`
+	PostID string `json:"postId"`
+}
+
+var jobHandlers = map[string]jobHandler{
+	"feed_fanout": func(ctx context.Context, payload json.RawMessage) error {
+		var p postJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		post, err := postByID(ctx, p.PostID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return feedFanout(ctx, post)
+	},
+	"post_mention_notifications": func(ctx context.Context, payload json.RawMessage) error {
+		var p postJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		post, err := postByID(ctx, p.PostID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return postMentionNotificationFanout(ctx, post)
+	},
+	"comment_notifications": func(ctx context.Context, payload json.RawMessage) error {
+		var p commentJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		comment, err := commentByID(ctx, p.CommentID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return commentNotificationFanout(ctx, comment)
+	},
+	"comment_mention_notifications": func(ctx context.Context, payload json.RawMessage) error {
+		var p commentJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		comment, err := commentByID(ctx, p.CommentID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return commentMentionNotificationFanout(ctx, comment)
+	},
+	"comment_reply_notification": func(ctx context.Context, payload json.RawMessage) error {
+		var p commentJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		comment, err := commentByID(ctx, p.CommentID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createCommentReplyNotification(ctx, comment)
+	},
+	"follow_notification": func(ctx context.Context, payload json.RawMessage) error {
+		var p followJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		follower, err := userByID(ctx, p.FollowerID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createFollowNotification(ctx, follower, p.FollowingID)
+	},
+	"feed_backfill": func(ctx context.Context, payload json.RawMessage) error {
+		var p followJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return feedBackfill(ctx, p.FollowerID, p.FollowingID)
+	},
+	"feed_prune": func(ctx context.Context, payload json.RawMessage) error {
+		var p followJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return feedPrune(ctx, p.FollowerID, p.FollowingID)
+	},
+	"repost_fanout": func(ctx context.Context, payload json.RawMessage) error {
+		var p repostJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return repostFanout(ctx, p.UserID, p.PostID)
+	},
+	"repost_prune": func(ctx context.Context, payload json.RawMessage) error {
+		var p repostJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return repostPrune(ctx, p.UserID, p.PostID)
+	},
+	"repost_notification": func(ctx context.Context, payload json.RawMessage) error {
+		var p repostJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		reposter, err := userByID(ctx, p.UserID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createRepostNotification(ctx, reposter, p.PostID)
+	},
+	"post_deletion_fanout": func(ctx context.Context, payload json.RawMessage) error {
+		var p postDeletionJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		return feedPublishMergedDeletion(ctx, p.UserID, p.PostID)
+	},
+	"quote_notification": func(ctx context.Context, payload json.RawMessage) error {
+		var p postJobPayload
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return err
+		}
+		post, err := postByID(ctx, p.PostID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return createQuoteNotification(ctx, post)
+	},
+}
+
+// enqueueJob inside the same transaction that creates the data the job works on,
+// so both are committed or none is.
+// Call jobWorkers.notify once committed to run it right away.
+func enqueueJob(tx *sql.Tx, kind string, payload interface{}) error {
+	if _, ok := jobHandlers[kind]; !ok {
+		return fmt.Errorf("unknown job kind %q", kind)
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal %s job payload: %v", kind, err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO jobs (kind, payload) VALUES ($1, $2)
+		RETURNING NOTHING
+	`, kind, b)
+	return err
+}
+
+// JobWorkers is a pool of goroutines running the jobs table.
+type JobWorkers struct {
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startJobWorkers(n int) *JobWorkers {
+	w := &JobWorkers{
+		wake: make(chan struct{}, n),
+		quit: make(chan struct{}),
+	}
+	w.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go w.loop()
+	}
+	return w
+}
+
+// every runs fn each interval, alongside the workers, until they stop.
+func (w *JobWorkers) every(interval time.Duration, fn func(ctx context.Context) error) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.quit:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), jobLockTimeout)
+			if err := fn(ctx); err != nil {
+				log.Println(err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// notify an idle worker that there are new jobs.
+func (w *JobWorkers) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stop claiming jobs and wait for the ones running to finish.
+// Pending jobs stay in the table for the next start.
+func (w *JobWorkers) stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+func (w *JobWorkers) loop() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+
+		job, err := claimJob()
+		if err != nil {
+			log.Println(err)
+		}
+
+		if job == nil {
+			select {
+			case <-w.quit:
+				return
+			case <-w.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		runJob(*job)
+	}
+}
+
+// claimJob locks the next due job, nil if there is none.
+func claimJob() (*Job, error) {
+	var job Job
+	if err := crdb.ExecuteTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+		return tx.QueryRow(`
+			UPDATE jobs SET
+				attempts = attempts + 1,
+				locked_until = now() + $1 * INTERVAL '1 second'
+			WHERE id = (
+				SELECT id FROM jobs
+				WHERE failed_at IS NULL
+					AND run_at <= now()
+					AND (locked_until IS NULL OR locked_until < now())
+				ORDER BY run_at
+				LIMIT 1
+			)
+			RETURNING id, kind, payload, attempts, max_attempts
+		`, int(jobLockTimeout.Seconds())).Scan(
+			&job.ID,
+			&job.Kind,
+			&job.Payload,
+			&job.Attempts,
+			&job.MaxAttempts,
+		)
+	}); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not claim job: %v", err)
+	}
+
+	return &job, nil
+}
+
+// runJob and record its outcome.
+// Failed jobs are retried with exponential backoff
+// until they run out of attempts, then kept with their last error.
+func runJob(job Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), jobLockTimeout)
+	defer cancel()
+
+	var err error
+	if handler, ok := jobHandlers[job.Kind]; ok {
+		err = handler(ctx, job.Payload)
+	} else {
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	if err == nil {
+		if _, err = db.Exec("DELETE FROM jobs WHERE id = $1", job.ID); err != nil {
+			log.Printf("could not delete done job: %v\n", err)
+		}
+		return
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		log.Printf("%s job %s failed for good: %v\n", job.Kind, job.ID, err)
+		if _, err = db.Exec(`
+			UPDATE jobs SET
+				failed_at = now(),
+				locked_until = NULL,
+				last_error = $2
+			WHERE id = $1
+		`, job.ID, err.Error()); err != nil {
+			log.Printf("could not mark job as failed: %v\n", err)
+		}
+		return
+	}
+
+	backoff := time.Second << uint(job.Attempts)
+	if backoff > jobMaxBackoff || backoff <= 0 {
+		backoff = jobMaxBackoff
+	}
+	log.Printf("%s job %s failed, retrying in %s: %v\n", job.Kind, job.ID, backoff, err)
+	if _, err = db.Exec(`
+		UPDATE jobs SET
+			run_at = now() + $2 * INTERVAL '1 second',
+			locked_until = NULL,
+			last_error = $3
+		WHERE id = $1
+	`, job.ID, int(backoff.Seconds()), err.Error()); err != nil {
+		log.Printf("could not reschedule job: %v\n", err)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -26,12 +27,19 @@ var appURL *url.URL
 var db *sql.DB
 var smtpAddress string
 var smtpAuth smtp.Auth
-var feedBroker *FeedBroker
-var commentsBroker *CommentsBroker
-var notificationsBroker *NotificationsBroker
+var broker *Broker
+var jobWorkers *JobWorkers
+
+// shuttingDown gets closed when the server starts shutting down,
+// so long-lived streams end and let it drain.
+var shuttingDown = make(chan struct{})
 
 func main() {
-	var port, domain, databaseURL, smtpHost, smtpUsername, smtpPassword string
+	var port, domain, databaseURL, smtpHost, smtpUsername, smtpPassword, brokerBackend, redisAddress string
+	var storageBackend, storageDir, cdnURL, s3Endpoint, s3AccessKey, s3SecretKey, s3Bucket string
+	var migrate, s3Secure bool
+	var workers int
+	var mediaTTL time.Duration
 	flag.StringVar(&port, "port", env("PORT", "80"), "HTTP port")
 	flag.StringVar(&domain, "domain", env("APP_URL", "http://localhost:"+port+"/"), "Domain")
 	flag.StringVar(&databaseURL, "crdb",
@@ -40,9 +48,57 @@ func main() {
 	flag.StringVar(&smtpHost, "smtphost", env("SMTP_HOST", "smtp.mailtrap.io"), "SMTP host")
 	flag.StringVar(&smtpUsername, "smtpuser", os.Getenv("SMTP_USERNAME"), "SMTP username")
 	flag.StringVar(&smtpPassword, "smtppwd", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&brokerBackend, "broker", env("BROKER", "memory"),
+		"Realtime broker backend: memory or redis. Use redis when running multiple instances")
+	flag.StringVar(&redisAddress, "redis", env("REDIS_ADDRESS", "127.0.0.1:6379"), "Redis address")
+	flag.StringVar(&storageBackend, "storage", env("STORAGE", "disk"),
+		"Storage backend for avatars and media: disk or s3. Use s3 when running multiple instances")
+	flag.StringVar(&storageDir, "storage-dir", env("STORAGE_DIR", "."), "Directory of the disk storage")
+	flag.StringVar(&cdnURL, "cdn", os.Getenv("CDN_URL"), "Base URL stored files are served from. Defaults to the app or the s3 bucket")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", env("S3_ENDPOINT", "127.0.0.1:9000"), "S3 endpoint")
+	flag.StringVar(&s3AccessKey, "s3-access-key", os.Getenv("S3_ACCESS_KEY"), "S3 access key")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", os.Getenv("S3_SECRET_KEY"), "S3 secret key")
+	flag.StringVar(&s3Bucket, "s3-bucket", env("S3_BUCKET", "nakama"), "S3 bucket")
+	flag.BoolVar(&s3Secure, "s3-secure", env("S3_SECURE", "false") == "true", "Use HTTPS to connect to S3")
+	flag.BoolVar(&migrate, "migrate", env("MIGRATE", "false") == "true", "Apply pending migrations on startup")
+	flag.IntVar(&workers, "workers", intEnv("WORKERS", 4), "Number of background job workers")
+	flag.IntVar(&fanoutThreshold, "fanout-threshold", intEnv("FANOUT_THRESHOLD", 10000),
+		"Followers count from which posts are merged into feeds on read instead of copied. 0 disables it")
+	flag.DurationVar(&mediaTTL, "media-ttl", durationEnv("MEDIA_TTL", time.Hour*24),
+		"How long uploaded media can go unattached to a post before being removed")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate [up | down [n]] | seed]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	var err error
+	db, err = sql.Open("postgres", databaseURL)
+	if err != nil {
+		log.Fatalf("could not open database connection: %v\n", err)
+	}
+	defer db.Close()
+	if err = db.Ping(); err != nil {
+		log.Fatalf("could not ping to database: %v\n", err)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		if err = runMigrateCommand(context.Background(), flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "seed":
+		if err = seed(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	appURL, err = url.Parse(domain)
 	if err != nil || !appURL.IsAbs() {
 		log.Fatal("could not parse domain url")
@@ -53,59 +109,119 @@ func main() {
 	if smtpPassword == "" {
 		log.Fatal("SMTP password required")
 	}
-
-	db, err = sql.Open("postgres", databaseURL)
-	if err != nil {
-		log.Fatalf("could not open database connection: %v\n", err)
+	if brokerBackend != "memory" && brokerBackend != "redis" {
+		log.Fatalf("unknown broker backend %q\n", brokerBackend)
 	}
-	defer db.Close()
-	if err = db.Ping(); err != nil {
-		log.Fatalf("could not ping to database: %v\n", err)
+	if storageBackend != "disk" && storageBackend != "s3" {
+		log.Fatalf("unknown storage backend %q\n", storageBackend)
+	}
+	if workers < 1 {
+		log.Fatal("at least one job worker required")
+	}
+	if fanoutThreshold < 0 {
+		log.Fatal("fanout threshold must not be negative")
+	}
+	if mediaTTL <= 0 {
+		log.Fatal("media ttl must be positive")
+	}
+
+	if migrate {
+		if err = migrateUp(context.Background()); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	smtpAddress = net.JoinHostPort(smtpHost, "25")
 	smtpAuth = smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
 
-	feedBroker = newFeedBroker()
-	defer close(feedBroker.Notifier)
-	commentsBroker = newCommentsBroker()
-	defer close(commentsBroker.Notifier)
-	notificationsBroker = newNotificationsBroker()
-	defer close(notificationsBroker.Notifier)
+	if brokerBackend == "redis" {
+		backend, err := newRedisBrokerBackend(redisAddress)
+		if err != nil {
+			log.Fatalf("could not create redis broker backend: %v\n", err)
+		}
+		broker = newBroker(backend)
+	} else {
+		broker = newBroker(newMemoryBrokerBackend())
+	}
+	defer broker.close()
+
+	if storageBackend == "s3" {
+		storage, err = newS3Storage(context.Background(), s3Endpoint, s3AccessKey, s3SecretKey, s3Bucket, s3Secure)
+		if err != nil {
+			log.Fatalf("could not create s3 storage: %v\n", err)
+		}
+		storageBaseURL, err = url.Parse(s3URL(s3Endpoint, s3Bucket, s3Secure))
+		if err != nil {
+			log.Fatalf("could not parse s3 url: %v\n", err)
+		}
+	} else {
+		storage = newDiskStorage(storageDir)
+		storageBaseURL = appURL
+	}
+	if cdnURL != "" {
+		storageBaseURL, err = url.Parse(cdnURL)
+		if err != nil || !storageBaseURL.IsAbs() {
+			log.Fatal("could not parse cdn url")
+		}
+	}
+
+	jobWorkers = startJobWorkers(workers)
+	jobWorkers.every(mediaCleanupInterval, func(ctx context.Context) error {
+		return cleanupMedia(ctx, mediaTTL)
+	})
 
 	mux := chi.NewMux()
 	mux.Use(middleware.Recoverer)
 	mux.Route("/api", func(api chi.Router) {
 		jsonRequired := middleware.AllowContentType("application/json")
 		imageRequired := middleware.AllowContentType("image/jpg", "image/jpeg", "image/png")
+		mediaRequired := middleware.AllowContentType("image/jpg", "image/jpeg", "image/png", "image/gif")
 		api.With(jsonRequired).Post("/passwordless/start", passwordlessStart)
 		api.Get("/passwordless/verify_redirect", passwordlessVerifyRedirect)
 		api.Post("/logout", logout)
 		api.With(mustAuthUser).Get("/me", getMe)
 		api.With(jsonRequired).Post("/users", createUser)
 		api.With(maybeAuthUserID).Get("/users", getUsers)
+		api.With(maybeAuthUserID).Get("/users/autocomplete", getUsersAutocomplete)
 		api.With(maybeAuthUserID).Get("/users/{username}", getUser)
 		api.With(imageRequired, mustAuthUser).Post("/upload_avatar", uploadAvatar)
 		api.With(mustAuthUser).Post("/users/{username}/toggle_follow", toggleFollow)
 		api.With(maybeAuthUserID).Get("/users/{username}/followers", getFollowers)
 		api.With(maybeAuthUserID).Get("/users/{username}/following", getFollowing)
+		api.With(mediaRequired, mustAuthUser).Post("/media", uploadMedia)
 		api.With(jsonRequired, mustAuthUser).Post("/posts", createPost)
 		api.With(maybeAuthUserID).Get("/users/{username}/posts", getPosts)
 		api.With(maybeAuthUserID).Get("/posts/{post_id}", getPost)
+		api.With(jsonRequired, mustAuthUser).Patch("/posts/{post_id}", updatePost)
+		api.With(mustAuthUser).Delete("/posts/{post_id}", deletePost)
+		api.Get("/posts/{post_id}/revisions", getPostRevisions)
+		api.Get("/tags/trending", getTrendingTags)
+		api.With(maybeAuthUserID).Get("/tags/{tag}/posts", getTagPosts)
+		api.Get("/search", search)
 		api.With(mustAuthUser).Get("/feed", getFeed)
 		api.With(jsonRequired, mustAuthUser).Post("/posts/{post_id}/comments", createComment)
 		api.With(maybeAuthUserID).Get("/posts/{post_id}/comments", getComments)
 		api.With(mustAuthUser).Post("/posts/{post_id}/toggle_like", togglePostLike)
+		api.With(mustAuthUser).Post("/posts/{post_id}/toggle_repost", togglePostRepost)
 		api.With(mustAuthUser).Post("/posts/{post_id}/toggle_subscription", toggleSubscription)
+		api.With(jsonRequired, mustAuthUser).Patch("/comments/{comment_id}", updateComment)
+		api.With(mustAuthUser).Delete("/comments/{comment_id}", deleteComment)
 		api.With(mustAuthUser).Post("/comments/{comment_id}/toggle_like", toggleCommentLike)
+		api.With(maybeAuthUserID).Get("/comments/{comment_id}/replies", getCommentReplies)
 		api.With(mustAuthUser).Get("/notifications", getNotifications)
 		api.With(mustAuthUser).Get("/check_unread_notifications", checkUnreadNotifications)
+		api.With(maybeAuthUserID).Get("/stream", getStream)
+		api.With(mustAuthUser).Get("/ws", serveWS)
 	})
 	mux.Get("/favicon.ico", serveFile("static/favicon.ico"))
+	if storageBackend == "disk" {
+		// Stored files are never overwritten, so no need for no cache.
+		mux.Method(http.MethodGet, "/avatars/*", diskStorageHandler(storageDir, "avatars"))
+		mux.Method(http.MethodGet, "/media/*", diskStorageHandler(storageDir, "media"))
+	}
 	mux.Group(func(mux chi.Router) {
 		// TODO: remove no cache
 		mux.Use(middleware.NoCache)
-		mux.Method(http.MethodGet, "/avatars/*", http.StripPrefix("/avatars/", http.FileServer(http.Dir("avatars"))))
 		mux.Method(http.MethodGet, "/js/*", http.FileServer(http.Dir("static")))
 		mux.Get("/styles.css", serveFile("static/styles.css"))
 		mux.Get("/*", serveFile("static/index.html"))
@@ -117,15 +233,20 @@ func main() {
 		ReadHeaderTimeout: time.Second * 5,
 		IdleTimeout:       time.Second * 30,
 	}
+	s.RegisterOnShutdown(func() {
+		close(shuttingDown)
+	})
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, os.Interrupt)
 		<-quit
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
 		if err := s.Shutdown(ctx); err != nil {
-			log.Fatalf("could not shutdown server: %v\n", err)
+			log.Printf("could not shutdown server: %v\n", err)
 		}
 	}()
 
@@ -133,6 +254,11 @@ func main() {
 	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("could not start server: %v\n", err)
 	}
+
+	// Unless the shutdown timed out, no more requests can enqueue jobs by now.
+	<-shutdownDone
+	log.Println("waiting for running jobs")
+	jobWorkers.stop()
 }
 
 func env(key, fallbackValue string) string {
@@ -143,6 +269,18 @@ func env(key, fallbackValue string) string {
 	return v
 }
 
+func intEnv(key string, fallbackValue int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallbackValue
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fallbackValue
+	}
+	return i
+}
+
 func respondError(w http.ResponseWriter, err error) {
 	log.Println(err)
 	http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -189,3 +327,15 @@ func sendMail(subject, to, body string) error {
 
 	return smtp.SendMail(smtpAddress, smtpAuth, from, []string{to}, []byte(msg))
 }
+
+func durationEnv(key string, fallbackValue time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fallbackValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallbackValue
+	}
+	return d
+}
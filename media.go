@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // to decode gif media
+	_ "image/jpeg" // to decode jpeg media
+	_ "image/png"  // to decode png media
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	mediaMaxSize      = 8 << 20
+	postMediaMaxCount = 4
+	altTextMaxLength  = 420
+
+	// mediaCleanupInterval is how often unattached media is looked for.
+	mediaCleanupInterval = time.Hour
+)
+
+// mediaExtensions by the content types allowed for media.
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var errMediaNotFound = errors.New("media not found")
+
+// Media model. An image uploaded to be attached to a post.
+type Media struct {
+	ID          string  `json:"id"`
+	URL         string  `json:"url"`
+	ContentType string  `json:"contentType"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	AltText     *string `json:"altText"`
+}
+
+// PostMediaInput attaches uploaded media to a post.
+type PostMediaInput struct {
+	ID      string  `json:"id"`
+	AltText *string `json:"altText,omitempty"`
+}
+
+func mediaURL(filename string) string {
+	return storageURL("media/" + filename)
+}
+
+// uploadMedia takes an image to attach to a post later.
+func uploadMedia(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, mediaMaxSize)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	ct := http.DetectContentType(b)
+	ext, ok := mediaExtensions[ct]
+	if !ok {
+		log.Printf("%s is not a valid image\n", ct)
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("could not decode %s media: %v\n", ct, err)
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Every upload gets its own file, even of the same image,
+	// so removing it never pulls the file from under another upload.
+	filename, err := randomFilename()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	filename += ext
+	if err = storage.Store(ctx, "media/"+filename, ct, b); err != nil {
+		respondError(w, fmt.Errorf("could not store media: %v", err))
+		return
+	}
+
+	authUserID := ctx.Value(keyAuthUserID).(string)
+
+	media := Media{
+		URL:         mediaURL(filename),
+		ContentType: ct,
+		Width:       config.Width,
+		Height:      config.Height,
+	}
+	if err = db.QueryRowContext(ctx, `
+		INSERT INTO media (user_id, filename, content_type, width, height)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, authUserID, filename, ct, media.Width, media.Height).Scan(&media.ID); err != nil {
+		removeMediaFiles(ctx, []string{filename})
+		respondError(w, fmt.Errorf("could not insert media: %v", err))
+		return
+	}
+
+	respondJSON(w, media, http.StatusCreated)
+}
+
+// attachPostMedia attaches the media uploaded by the user to the post, in order.
+// Media of someone else or already attached is errMediaNotFound.
+func attachPostMedia(tx *sql.Tx, postID, userID string, inputs []PostMediaInput) ([]Media, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+
+	mm := make([]Media, 0, len(inputs))
+	for i, input := range inputs {
+		media := Media{ID: input.ID, AltText: input.AltText}
+		var filename string
+		if err := tx.QueryRow(`
+			UPDATE media SET post_id = $1, position = $2, alt_text = $3
+			WHERE id = $4 AND user_id = $5 AND post_id IS NULL
+			RETURNING filename, content_type, width, height
+		`, postID, i, input.AltText, input.ID, userID).Scan(
+			&filename,
+			&media.ContentType,
+			&media.Width,
+			&media.Height,
+		); err == sql.ErrNoRows {
+			return nil, errMediaNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		media.URL = mediaURL(filename)
+		mm = append(mm, media)
+	}
+	return mm, nil
+}
+
+// postsMedia loads the media of the given posts, by post id.
+func postsMedia(ctx context.Context, postIDs []string) (map[string][]Media, error) {
+	byPostID := map[string][]Media{}
+	if len(postIDs) == 0 {
+		return byPostID, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, post_id, filename, content_type, width, height, alt_text
+		FROM media
+		WHERE post_id = ANY($1)
+		ORDER BY post_id, position
+	`, pq.Array(postIDs))
+	if err != nil {
+		return nil, fmt.Errorf("could not query posts media: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var media Media
+		var postID, filename string
+		if err = rows.Scan(
+			&media.ID,
+			&postID,
+			&filename,
+			&media.ContentType,
+			&media.Width,
+			&media.Height,
+			&media.AltText,
+		); err != nil {
+			return nil, fmt.Errorf("could not scan post media: %v", err)
+		}
+
+		media.URL = mediaURL(filename)
+		byPostID[postID] = append(byPostID[postID], media)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over posts media: %v", err)
+	}
+
+	return byPostID, nil
+}
+
+// withPostsMedia sets the media of the given posts.
+func withPostsMedia(ctx context.Context, posts []*Post) error {
+	postIDs := make([]string, len(posts))
+	for i, post := range posts {
+		postIDs[i] = post.ID
+	}
+
+	byPostID, err := postsMedia(ctx, postIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		post.Media = byPostID[post.ID]
+	}
+	return nil
+}
+
+// removeMediaFiles deletes the files of removed media.
+// Failures are just logged; the rows are gone already.
+func removeMediaFiles(ctx context.Context, filenames []string) {
+	for _, filename := range filenames {
+		if err := storage.Delete(ctx, "media/"+filename); err != nil {
+			log.Printf("could not remove media file: %v\n", err)
+		}
+	}
+}
+
+// randomFilename for a new media file.
+func randomFilename() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate media filename: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// cleanupMedia removes media uploaded more than ttl ago
+// and never attached to a post, along with its files.
+func cleanupMedia(ctx context.Context, ttl time.Duration) error {
+	rows, err := db.QueryContext(ctx, `
+		DELETE FROM media
+		WHERE post_id IS NULL
+			AND created_at < now() - $1 * INTERVAL '1 second'
+		RETURNING filename
+	`, int(ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("could not delete unattached media: %v", err)
+	}
+
+	defer rows.Close()
+
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err = rows.Scan(&filename); err != nil {
+			return fmt.Errorf("could not scan unattached media filename: %v", err)
+		}
+		filenames = append(filenames, filename)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("could not iterate over unattached media: %v", err)
+	}
+
+	removeMediaFiles(ctx, filenames)
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+//go:embed seed.sql
+var seedSQL string
+
+// Migration is a versioned schema change.
+// Files in the migrations directory are named <version>_<name>.up.sql
+// and <version>_<name>.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations dir: %v", err)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		filename := entry.Name()
+		var direction string
+		if strings.HasSuffix(filename, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(filename, ".down.sql") {
+			direction = "down"
+		} else {
+			continue
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration filename %q", filename)
+		}
+
+		b, err := migrationsFS.ReadFile(path.Join("migrations", filename))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %q: %v", filename, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT NOT NULL PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return nil, fmt.Errorf("could not create schema_migrations table: %v", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("could not query schema migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("could not scan schema migration: %v", err)
+		}
+		applied[version] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over schema migrations: %v", err)
+	}
+
+	return applied, nil
+}
+
+// migrateUp applies every pending migration, oldest first.
+func migrateUp(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		if err = crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Up); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(`
+				INSERT INTO schema_migrations (version) VALUES ($1)
+				RETURNING NOTHING
+			`, m.Version)
+			return err
+		}); err != nil {
+			return fmt.Errorf("could not apply migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+
+		log.Printf("applied migration %04d_%s\n", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// migrateDown reverts the last n applied migrations, newest first.
+func migrateDown(ctx context.Context, n int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		m := migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+		if m.Down == "" {
+			return fmt.Errorf("migration %04d_%s has no down file", m.Version, m.Name)
+		}
+
+		if err = crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(m.Down); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(`
+				DELETE FROM schema_migrations WHERE version = $1
+				RETURNING NOTHING
+			`, m.Version)
+			return err
+		}); err != nil {
+			return fmt.Errorf("could not revert migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+
+		log.Printf("reverted migration %04d_%s\n", m.Version, m.Name)
+		n--
+	}
+
+	return nil
+}
+
+// seed inserts development data. Never run it against production.
+func seed(ctx context.Context) error {
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		_, err := tx.Exec(seedSQL)
+		return err
+	}); err != nil {
+		return fmt.Errorf("could not seed database: %v", err)
+	}
+
+	return nil
+}
+
+// runMigrateCommand handles `nakama migrate [up | down [n]]`.
+func runMigrateCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] == "up" {
+		return migrateUp(ctx)
+	}
+
+	if args[0] != "down" {
+		return fmt.Errorf("unknown migrate direction %q", args[0])
+	}
+
+	n := 1
+	if len(args) > 1 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			return fmt.Errorf("invalid number of migrations to revert %q", args[1])
+		}
+	}
+	return migrateDown(ctx, n)
+}
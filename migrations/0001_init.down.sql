@@ -0,0 +1,10 @@
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS comment_likes;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS feed;
+DROP TABLE IF EXISTS subscriptions;
+DROP TABLE IF EXISTS post_likes;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS follows;
+DROP TABLE IF EXISTS verification_codes;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS posts@posts_user_id_created_at_idx;
+DROP INDEX IF EXISTS feed@feed_user_id_post_id_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS feed_user_id_post_id_idx ON feed (user_id, post_id);
+CREATE INDEX IF NOT EXISTS posts_user_id_created_at_idx ON posts (user_id, created_at DESC);
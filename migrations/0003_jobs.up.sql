@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL NOT NULL PRIMARY KEY,
+    kind STRING(64) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 10,
+    run_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ,
+    last_error STRING,
+    failed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (failed_at, run_at)
+);
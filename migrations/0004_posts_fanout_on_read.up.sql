@@ -0,0 +1 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS fanout_on_read BOOL NOT NULL DEFAULT false;
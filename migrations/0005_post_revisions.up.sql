@@ -0,0 +1,10 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
+
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id SERIAL NOT NULL PRIMARY KEY,
+    post_id INT NOT NULL REFERENCES posts,
+    content STRING(480) NOT NULL,
+    spoiler_of STRING(128),
+    created_at TIMESTAMPTZ NOT NULL,
+    INDEX (post_id, created_at DESC)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE comments DROP COLUMN IF EXISTS replies_count;
+ALTER TABLE comments DROP COLUMN IF EXISTS parent_comment_id;
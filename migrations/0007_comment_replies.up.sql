@@ -0,0 +1,2 @@
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS parent_comment_id INT;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS replies_count INT NOT NULL DEFAULT 0 CHECK (replies_count >= 0);
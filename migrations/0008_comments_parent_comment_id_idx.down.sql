@@ -0,0 +1 @@
+DROP INDEX IF EXISTS comments@comments_parent_comment_id_created_at_idx;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS comments_parent_comment_id_created_at_idx ON comments (parent_comment_id, created_at DESC);
@@ -0,0 +1,8 @@
+ALTER TABLE feed DROP COLUMN IF EXISTS reposted_at;
+ALTER TABLE feed DROP COLUMN IF EXISTS reposted_by_id;
+
+ALTER TABLE posts DROP COLUMN IF EXISTS quote_of_id;
+ALTER TABLE posts DROP COLUMN IF EXISTS quotes_count;
+ALTER TABLE posts DROP COLUMN IF EXISTS reposts_count;
+
+DROP TABLE IF EXISTS reposts;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS reposts (
+    user_id INT NOT NULL REFERENCES users,
+    post_id INT NOT NULL REFERENCES posts,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, post_id)
+);
+
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS reposts_count INT NOT NULL DEFAULT 0 CHECK (reposts_count >= 0);
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS quotes_count INT NOT NULL DEFAULT 0 CHECK (quotes_count >= 0);
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS quote_of_id INT;
+
+ALTER TABLE feed ADD COLUMN IF NOT EXISTS reposted_by_id INT;
+ALTER TABLE feed ADD COLUMN IF NOT EXISTS reposted_at TIMESTAMPTZ;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS post_tags (
+    post_id INT NOT NULL REFERENCES posts,
+    tag STRING NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (post_id, tag),
+    INDEX (tag, created_at DESC),
+    INDEX (created_at DESC)
+);
@@ -0,0 +1,4 @@
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS search_vector TSVECTOR
+    AS (to_tsvector('english', content)) STORED;
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS search_vector TSVECTOR
+    AS (to_tsvector('english', content)) STORED;
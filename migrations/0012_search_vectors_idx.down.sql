@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS comments@comments_search_vector_idx;
+DROP INDEX IF EXISTS posts@posts_search_vector_idx;
@@ -0,0 +1,2 @@
+CREATE INVERTED INDEX IF NOT EXISTS posts_search_vector_idx ON posts (search_vector);
+CREATE INVERTED INDEX IF NOT EXISTS comments_search_vector_idx ON comments (search_vector);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users@users_username_trgm_idx;
+DROP INDEX IF EXISTS users@users_lower_username_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS users_lower_username_idx ON users (lower(username));
+CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN (username gin_trgm_ops);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS media (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users,
+    post_id INT REFERENCES posts,
+    position INT NOT NULL DEFAULT 0,
+    filename STRING NOT NULL UNIQUE,
+    content_type STRING NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    alt_text STRING(420),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    INDEX (post_id, position)
+);
@@ -0,0 +1 @@
+COMMENT ON COLUMN users.avatar_url IS NULL;
@@ -0,0 +1,4 @@
+UPDATE users SET avatar_url = regexp_replace(avatar_url, '^.*/(avatars/[^/]+)$', '\1')
+    WHERE avatar_url ~ '^[a-z]+://.*/avatars/[^/]+$';
+
+COMMENT ON COLUMN users.avatar_url IS 'Storage name of the medium avatar, like avatars/1-<hash>-128.jpg; its URL is built on read. Absolute URLs are returned as they are.';
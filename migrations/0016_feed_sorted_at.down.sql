@@ -0,0 +1 @@
+ALTER TABLE feed DROP COLUMN IF EXISTS sorted_at;
@@ -0,0 +1 @@
+ALTER TABLE feed ADD COLUMN IF NOT EXISTS sorted_at TIMESTAMPTZ NOT NULL DEFAULT now();
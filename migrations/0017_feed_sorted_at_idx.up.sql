@@ -0,0 +1,8 @@
+UPDATE feed SET sorted_at = COALESCE(
+    reposted_at,
+    (SELECT created_at FROM posts WHERE posts.id = feed.post_id),
+    sorted_at
+);
+
+CREATE INDEX IF NOT EXISTS feed_user_id_sorted_at_idx ON feed (user_id, sorted_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS posts_user_id_created_at_id_idx ON posts (user_id, created_at DESC, id DESC);
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,41 +27,22 @@ type Notification struct {
 	ActorUsername string    `json:"actorUsername"`
 }
 
+func notificationsTopic(userID string) string {
+	return "notifications:" + userID
+}
+
 func getNotifications(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	authUserID := ctx.Value(keyAuthUserID).(string)
 
 	if a := r.Header.Get("Accept"); strings.Contains(a, "text/event-stream") {
-		f, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-			return
-		}
-
-		h := w.Header()
-		h.Set("Cache-Control", "no-cache")
-		h.Set("Connection", "keep-alive")
-		h.Set("Content-Type", "text/event-stream")
-
-		ch, unsubscribe := notificationsBroker.subscribe(authUserID)
-		defer unsubscribe()
-
-		for {
-			select {
-			case <-w.(http.CloseNotifier).CloseNotify():
-				return
-			case <-time.After(time.Second * 15):
-				fmt.Fprint(w, "ping: \n\n")
-				f.Flush()
-			case notification := <-ch:
-				if b, err := json.Marshal(notification); err != nil {
-					fmt.Fprintf(w, "error: %v\n\n", err)
-				} else {
-					fmt.Fprintf(w, "data: %s\n\n", b)
-				}
-				f.Flush()
-			}
-		}
+		streamSSE(w, r, sseStream{
+			topic: notificationsTopic(authUserID),
+			replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+				return notificationsSince(ctx, authUserID, lastEventID)
+			},
+		})
+		return
 	}
 
 	rows, err := db.QueryContext(ctx, `
@@ -115,6 +95,59 @@ func getNotifications(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, notifications, http.StatusOK)
 }
 
+// notificationsSince returns the user's notifications issued after lastID.
+func notificationsSince(ctx context.Context, userID, lastID string) ([]Message, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			notifications.id,
+			actors.username,
+			notifications.verb,
+			notifications.object_id,
+			notifications.target_id,
+			notifications.issued_at,
+			notifications.issued_at <= users.notifications_seen_at AS read
+		FROM notifications
+		INNER JOIN users AS actors ON notifications.actor_id = actors.id
+		INNER JOIN users ON notifications.user_id = users.id
+		WHERE notifications.user_id = $1
+			AND notifications.id > $2
+		ORDER BY notifications.id
+		LIMIT $3
+	`, userID, lastID, sseReplayLimit)
+	if err != nil {
+		return nil, fmt.Errorf("could not query notifications since: %v", err)
+	}
+	defer rows.Close()
+
+	msgs := make([]Message, 0)
+	for rows.Next() {
+		var notification Notification
+		if err = rows.Scan(
+			&notification.ID,
+			&notification.ActorUsername,
+			&notification.Verb,
+			&notification.ObjectID,
+			&notification.TargetID,
+			&notification.IssuedAt,
+			&notification.Read,
+		); err != nil {
+			return nil, fmt.Errorf("could not scan notification: %v", err)
+		}
+
+		msg, err := newMessage(notificationsTopic(userID), notification.ID, "", notification)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not iterate over notifications: %v", err)
+	}
+
+	return msgs, nil
+}
+
 func updateNotificationsSeenAt(userID string) {
 	if _, err := db.Exec(`
 		UPDATE users SET
@@ -143,10 +176,10 @@ func checkUnreadNotifications(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, unread, http.StatusOK)
 }
 
-func createFollowNotification(follower User, followingID string) {
+func createFollowNotification(ctx context.Context, follower User, followingID string) error {
 	var exists bool
 	var notification Notification
-	if err := crdb.ExecuteTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM notifications
 			WHERE user_id = $1
@@ -165,8 +198,7 @@ func createFollowNotification(follower User, followingID string) {
 			RETURNING id, issued_at
 		`, followingID, follower.ID).Scan(&notification.ID, &notification.IssuedAt)
 	}); err != nil {
-		log.Printf("could not create follow notification: %v\n", err)
-		return
+		return fmt.Errorf("could not create follow notification: %v", err)
 	}
 
 	notification.UserID = followingID
@@ -176,21 +208,33 @@ func createFollowNotification(follower User, followingID string) {
 	created := !exists
 
 	if created {
-		notificationsBroker.Notifier <- notification
+		broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
 	}
+
+	return nil
 }
 
-func commentNotificationFanout(comment Comment) {
-	rows, err := db.Query(`
+// commentNotificationFanout notifies the post subscribers about the comment.
+// Subscribers already notified are skipped so the job can be retried,
+// same for the mention fanouts.
+// The author of the comment replied to gets a comment_reply notification instead.
+func commentNotificationFanout(ctx context.Context, comment Comment) error {
+	rows, err := db.QueryContext(ctx, `
 		INSERT INTO notifications (user_id, actor_id, verb, object_id, target_id)
 		SELECT user_id, $1, 'comment', $2, $3
 		FROM subscriptions
 		WHERE user_id != $1 AND post_id = $3
+			AND user_id IS DISTINCT FROM (SELECT user_id FROM comments WHERE id = $4)
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE notifications.user_id = subscriptions.user_id
+					AND verb = 'comment'
+					AND object_id = $2
+			)
 		RETURNING id, user_id, issued_at
-	`, comment.UserID, comment.ID, comment.PostID)
+	`, comment.UserID, comment.ID, comment.PostID, comment.ParentCommentID)
 	if err != nil {
-		log.Printf("could not query comment notification fanout: %v\n", err)
-		return
+		return fmt.Errorf("could not query comment notification fanout: %v", err)
 	}
 	defer rows.Close()
 
@@ -201,8 +245,7 @@ func commentNotificationFanout(comment Comment) {
 			&notification.UserID,
 			&notification.IssuedAt,
 		); err != nil {
-			log.Printf("could not scan comment notification fanout: %v\n", err)
-			return
+			return fmt.Errorf("could not scan comment notification fanout: %v", err)
 		}
 
 		notification.ActorID = comment.UserID
@@ -211,37 +254,154 @@ func commentNotificationFanout(comment Comment) {
 		notification.TargetID = &comment.PostID
 		notification.ActorUsername = comment.User.Username
 
-		notificationsBroker.Notifier <- notification
+		broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("could not iterate over comment notification fanout: %v\n", err)
+		return fmt.Errorf("could not iterate over comment notification fanout: %v", err)
+	}
+
+	return nil
+}
+
+// createCommentReplyNotification notifies the author of the comment replied to.
+func createCommentReplyNotification(ctx context.Context, reply Comment) error {
+	if reply.ParentCommentID == nil {
+		return nil
+	}
+
+	notification := Notification{
+		ActorID:       reply.UserID,
+		Verb:          "comment_reply",
+		ObjectID:      &reply.ID,
+		TargetID:      &reply.PostID,
+		ActorUsername: reply.User.Username,
 	}
+	if err := db.QueryRowContext(ctx, `
+		INSERT INTO notifications (user_id, actor_id, verb, object_id, target_id)
+		SELECT user_id, $1, 'comment_reply', $2, $3
+		FROM comments
+		WHERE id = $4 AND user_id != $1
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE verb = 'comment_reply' AND object_id = $2
+			)
+		RETURNING id, user_id, issued_at
+	`, reply.UserID, reply.ID, reply.PostID, *reply.ParentCommentID).Scan(
+		&notification.ID,
+		&notification.UserID,
+		&notification.IssuedAt,
+	); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not create comment reply notification: %v", err)
+	}
+
+	broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
+
+	return nil
+}
+
+// createRepostNotification notifies the author of the post reposted by the user.
+// Reposting it again after undoing doesn't notify twice.
+func createRepostNotification(ctx context.Context, reposter User, postID string) error {
+	notification := Notification{
+		ActorID:       reposter.ID,
+		Verb:          "repost",
+		ObjectID:      &postID,
+		ActorUsername: reposter.Username,
+	}
+	if err := db.QueryRowContext(ctx, `
+		INSERT INTO notifications (user_id, actor_id, verb, object_id)
+		SELECT user_id, $1, 'repost', $2
+		FROM posts
+		WHERE id = $2 AND user_id != $1
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE actor_id = $1 AND verb = 'repost' AND object_id = $2
+			)
+		RETURNING id, user_id, issued_at
+	`, reposter.ID, postID).Scan(
+		&notification.ID,
+		&notification.UserID,
+		&notification.IssuedAt,
+	); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not create repost notification: %v", err)
+	}
+
+	broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
+
+	return nil
+}
+
+// createQuoteNotification notifies the author of the post quoted.
+func createQuoteNotification(ctx context.Context, quote Post) error {
+	if quote.QuoteOfID == nil {
+		return nil
+	}
+
+	notification := Notification{
+		ActorID:       quote.UserID,
+		Verb:          "quote",
+		ObjectID:      &quote.ID,
+		TargetID:      quote.QuoteOfID,
+		ActorUsername: quote.User.Username,
+	}
+	if err := db.QueryRowContext(ctx, `
+		INSERT INTO notifications (user_id, actor_id, verb, object_id, target_id)
+		SELECT user_id, $1, 'quote', $2, $3
+		FROM posts
+		WHERE id = $3 AND user_id != $1
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE verb = 'quote' AND object_id = $2
+			)
+		RETURNING id, user_id, issued_at
+	`, quote.UserID, quote.ID, *quote.QuoteOfID).Scan(
+		&notification.ID,
+		&notification.UserID,
+		&notification.IssuedAt,
+	); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not create quote notification: %v", err)
+	}
+
+	broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
+
+	return nil
 }
 
 func collectMentions(content string) []string {
 	return mention.GetTagsAsUniqueStrings('@', content, ',', '.', '!', '?', '"', ')')
 }
 
-func postMentionNotificationFanout(post Post) {
+func postMentionNotificationFanout(ctx context.Context, post Post) error {
 	usernames := collectMentions(post.Content)
 	if len(usernames) == 0 {
-		return
+		return nil
 	}
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(ctx, `
 		INSERT INTO notifications (user_id, actor_id, verb, object_id)
 		SELECT id, $1, 'post_mention', $2
 		FROM users
 		WHERE id != $1
 			AND username = ANY($3)
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE notifications.user_id = users.id
+					AND verb = 'post_mention'
+					AND object_id = $2
+			)
 		RETURNING id, user_id, issued_at
 	`, post.UserID, post.ID, pq.Array(usernames))
 	if err != nil {
-		log.Printf("could not query post mention notification fanout: %v\n", err)
-		return
+		return fmt.Errorf("could not query post mention notification fanout: %v", err)
 	}
-	defer rows.Err()
+	defer rows.Close()
 
 	for rows.Next() {
 		var notification Notification
@@ -250,8 +410,7 @@ func postMentionNotificationFanout(post Post) {
 			&notification.UserID,
 			&notification.IssuedAt,
 		); err != nil {
-			log.Printf("could not scan post mention notification fanout: %v\n", err)
-			return
+			return fmt.Errorf("could not scan post mention notification fanout: %v", err)
 		}
 
 		notification.ActorID = post.UserID
@@ -259,33 +418,40 @@ func postMentionNotificationFanout(post Post) {
 		notification.ObjectID = &post.ID
 		notification.ActorUsername = post.User.Username
 
-		notificationsBroker.Notifier <- notification
+		broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("could not iterate over post mention notification fanout: %v\n", err)
+		return fmt.Errorf("could not iterate over post mention notification fanout: %v", err)
 	}
+
+	return nil
 }
 
-func commentMentionNotificationFanout(comment Comment) {
+func commentMentionNotificationFanout(ctx context.Context, comment Comment) error {
 	usernames := collectMentions(comment.Content)
 	if len(usernames) == 0 {
-		return
+		return nil
 	}
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(ctx, `
 		INSERT INTO notifications (user_id, actor_id, verb, object_id, target_id)
 		SELECT id, $1, 'comment_mention', $2, $3
 		FROM users
 		WHERE id != $1
 			AND username = ANY($4)
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE notifications.user_id = users.id
+					AND verb = 'comment_mention'
+					AND object_id = $2
+			)
 		RETURNING id, user_id, issued_at
 	`, comment.UserID, comment.ID, comment.PostID, pq.Array(usernames))
 	if err != nil {
-		log.Printf("could not query comment mention notification fanout: %v\n", err)
-		return
+		return fmt.Errorf("could not query comment mention notification fanout: %v", err)
 	}
-	defer rows.Err()
+	defer rows.Close()
 
 	for rows.Next() {
 		var notification Notification
@@ -294,8 +460,7 @@ func commentMentionNotificationFanout(comment Comment) {
 			&notification.UserID,
 			&notification.IssuedAt,
 		); err != nil {
-			log.Printf("could not scan comment mention notification fanout: %v\n", err)
-			return
+			return fmt.Errorf("could not scan comment mention notification fanout: %v", err)
 		}
 
 		notification.ActorID = comment.UserID
@@ -304,10 +469,12 @@ func commentMentionNotificationFanout(comment Comment) {
 		notification.TargetID = &comment.PostID
 		notification.ActorUsername = comment.User.Username
 
-		notificationsBroker.Notifier <- notification
+		broker.publish(notificationsTopic(notification.UserID), notification.ID, notification.ActorID, notification)
 	}
 
 	if err = rows.Err(); err != nil {
-		log.Printf("could not iterate over comment mention notification fanout: %v\n", err)
+		return fmt.Errorf("could not iterate over comment mention notification fanout: %v", err)
 	}
+
+	return nil
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 25
+	maxPageLimit     = 100
+)
+
+// Page response body for paginated lists.
+// To get the next page pass the cursor (username for followers and following)
+// of the last item as "before" in lists sorted newest first,
+// or as "after" in users lists.
+// HasMore tells whether there are more items past this page in the requested direction.
+type Page struct {
+	Items   interface{} `json:"items"`
+	HasMore bool        `json:"hasMore"`
+}
+
+// PageParams parsed from the before, after and limit query params.
+type PageParams struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+func parsePageParams(q url.Values) (PageParams, map[string]string) {
+	params := PageParams{
+		Before: strings.TrimSpace(q.Get("before")),
+		After:  strings.TrimSpace(q.Get("after")),
+		Limit:  defaultPageLimit,
+	}
+
+	if s := strings.TrimSpace(q.Get("limit")); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return params, map[string]string{
+				"limit": "Limit must be between 1 and " + strconv.Itoa(maxPageLimit),
+			}
+		}
+		params.Limit = limit
+	}
+
+	return params, nil
+}
+
+// backwards reports whether the page has to be queried in the opposite order of the list,
+// that is when only paging towards its start.
+// Queries in that direction must be reversed afterwards.
+func (p PageParams) backwards(newestFirst bool) bool {
+	if newestFirst {
+		return p.After != "" && p.Before == ""
+	}
+	return p.Before != "" && p.After == ""
+}
+
+// orderBy builds the ORDER BY clause of a page of a list sorted by cols,
+// like "posts.created_at DESC". The order is flipped when paging backwards,
+// trim puts the items back afterwards.
+func (p PageParams) orderBy(newestFirst bool, cols ...string) string {
+	if p.backwards(newestFirst) {
+		flipped := make([]string, len(cols))
+		for i, col := range cols {
+			if strings.HasSuffix(col, " DESC") {
+				flipped[i] = strings.TrimSuffix(col, " DESC") + " ASC"
+			} else {
+				flipped[i] = strings.TrimSuffix(col, " ASC") + " DESC"
+			}
+		}
+		cols = flipped
+	}
+	return `
+		ORDER BY ` + strings.Join(cols, ", ")
+}
+
+// limit builds the LIMIT clause of a page, appending its arg.
+// It fetches one item more than the page to tell whether there are more.
+func (p PageParams) limit(args []interface{}) (string, []interface{}) {
+	args = append(args, p.Limit+1)
+	return fmt.Sprintf(`
+		LIMIT $%d`, len(args)), args
+}
+
+// trim the items of a page, a slice queried with orderBy and limit,
+// returning how many to keep and whether there are more.
+// Items queried backwards are reversed into the list order.
+func (p PageParams) trim(newestFirst bool, items interface{}) (int, bool) {
+	v := reflect.ValueOf(items)
+	n := v.Len()
+	hasMore := n > p.Limit
+	if hasMore {
+		n = p.Limit
+	}
+
+	if p.backwards(newestFirst) {
+		swap := reflect.Swapper(v.Slice(0, n).Interface())
+		for i, j := 0, n-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	return n, hasMore
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor builds an opaque cursor for lists sorted by creation time and id.
+func encodeCursor(createdAt time.Time, id string) string {
+	s := createdAt.UTC().Format(time.RFC3339Nano) + "," + id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", errInvalidCursor
+	}
+
+	if _, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", errInvalidCursor
+	}
+
+	return createdAt, parts[1], nil
+}
+
+// cursorErrs validates before and after as cursors made by encodeCursor.
+func (p PageParams) cursorErrs() map[string]string {
+	errs := make(map[string]string)
+	if p.Before != "" {
+		if _, _, err := decodeCursor(p.Before); err != nil {
+			errs["before"] = "Invalid cursor"
+		}
+	}
+	if p.After != "" {
+		if _, _, err := decodeCursor(p.After); err != nil {
+			errs["after"] = "Invalid cursor"
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// cursorConds builds the conditions for the before and after cursors
+// of a list sorted by createdAtCol and idCol, appending their args.
+// The cursors must be validated with cursorErrs first.
+// They don't reference the row they were taken from, so it can be gone.
+func (p PageParams) cursorConds(createdAtCol, idCol string, args []interface{}) (string, []interface{}) {
+	var conds string
+	if p.Before != "" {
+		createdAt, id, _ := decodeCursor(p.Before)
+		args = append(args, createdAt, id)
+		conds += fmt.Sprintf(`
+			AND (%s, %s) < ($%d, $%d)`, createdAtCol, idCol, len(args)-1, len(args))
+	}
+	if p.After != "" {
+		createdAt, id, _ := decodeCursor(p.After)
+		args = append(args, createdAt, id)
+		conds += fmt.Sprintf(`
+			AND (%s, %s) > ($%d, $%d)`, createdAtCol, idCol, len(args)-1, len(args))
+	}
+	return conds, args
+}
+
+// encodeRankCursor builds an opaque cursor for lists sorted by rank, creation time and id.
+func encodeRankCursor(rank float64, createdAt time.Time, id string) string {
+	s := strconv.FormatFloat(rank, 'g', -1, 64) + "," + createdAt.UTC().Format(time.RFC3339Nano) + "," + id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeRankCursor(cursor string) (float64, time.Time, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ",", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	rank, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return 0, time.Time{}, "", errInvalidCursor
+	}
+
+	return rank, createdAt, parts[2], nil
+}
+
+// encodeUserRankCursor builds an opaque cursor for the users search,
+// sorted by match rank, relation rank, followers count and username.
+func encodeUserRankCursor(matchRank, relationRank, followersCount int, username string) string {
+	s := strconv.Itoa(matchRank) + "," + strconv.Itoa(relationRank) + "," + strconv.Itoa(followersCount) + "," + username
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeUserRankCursor(cursor string) (int, int, int, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, 0, "", errInvalidCursor
+	}
+
+	parts := strings.SplitN(string(b), ",", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		return 0, 0, 0, "", errInvalidCursor
+	}
+
+	ranks := make([]int, 3)
+	for i := range ranks {
+		if ranks[i], err = strconv.Atoi(parts[i]); err != nil {
+			return 0, 0, 0, "", errInvalidCursor
+		}
+	}
+
+	return ranks[0], ranks[1], ranks[2], parts[3], nil
+}
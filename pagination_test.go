@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	gotCreatedAt, gotID, err := decodeCursor(encodeCursor(createdAt, "42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotCreatedAt.Equal(createdAt) || gotID != "42" {
+		t.Errorf("decodeCursor() = %v, %q, want %v, %q", gotCreatedAt, gotID, createdAt, "42")
+	}
+}
+
+func TestPageParamsCursorErrs(t *testing.T) {
+	valid := encodeCursor(time.Now(), "1")
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name   string
+		params PageParams
+		want   map[string]string
+	}{
+		{"none", PageParams{}, nil},
+		{"valid", PageParams{Before: valid, After: valid}, nil},
+		{"plain id", PageParams{Before: "1"}, map[string]string{"before": "Invalid cursor"}},
+		{"not base64", PageParams{After: "!!"}, map[string]string{"after": "Invalid cursor"}},
+		{"no id", PageParams{Before: encode(time.Now().Format(time.RFC3339Nano) + ",")}, map[string]string{"before": "Invalid cursor"}},
+		{"non integer id", PageParams{Before: encode(time.Now().Format(time.RFC3339Nano) + ",abc")}, map[string]string{"before": "Invalid cursor"}},
+		{"bad time", PageParams{After: encode("yesterday,1")}, map[string]string{"after": "Invalid cursor"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.params.cursorErrs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cursorErrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageParamsCursorConds(t *testing.T) {
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	page := PageParams{Before: encodeCursor(createdAt, "7"), After: encodeCursor(createdAt, "3")}
+	conds, args := page.cursorConds("posts.created_at", "posts.id", []interface{}{"john"})
+
+	wantConds := `
+			AND (posts.created_at, posts.id) < ($2, $3)
+			AND (posts.created_at, posts.id) > ($4, $5)`
+	if conds != wantConds {
+		t.Errorf("cursorConds() conds = %q, want %q", conds, wantConds)
+	}
+	wantArgs := []interface{}{"john", createdAt, "7", createdAt, "3"}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("cursorConds() args = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestUserRankCursor(t *testing.T) {
+	matchRank, relationRank, followersCount, username, err := decodeUserRankCursor(encodeUserRankCursor(3, 2, 10, "john"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matchRank != 3 || relationRank != 2 || followersCount != 10 || username != "john" {
+		t.Errorf("decodeUserRankCursor() = %d, %d, %d, %q", matchRank, relationRank, followersCount, username)
+	}
+
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for _, cursor := range []string{"john", encode("3,2,john"), encode("3,2,10,"), encode("3,x,10,john")} {
+		if _, _, _, _, err := decodeUserRankCursor(cursor); err != errInvalidCursor {
+			t.Errorf("decodeUserRankCursor(%q) err = %v, want %v", cursor, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestPageParamsOrderBy(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      PageParams
+		newestFirst bool
+		want        string
+	}{
+		{"first page", PageParams{}, true, "created_at DESC, id DESC"},
+		{"before", PageParams{Before: "x"}, true, "created_at DESC, id DESC"},
+		{"after", PageParams{After: "x"}, true, "created_at ASC, id ASC"},
+		{"after alphabetical", PageParams{After: "x"}, false, "created_at DESC, id DESC"},
+		{"before alphabetical", PageParams{Before: "x"}, false, "created_at ASC, id ASC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.params.orderBy(tt.newestFirst, "created_at DESC", "id DESC"); got != "\n\t\tORDER BY "+tt.want {
+				t.Errorf("orderBy() = %q, want ORDER BY %s", got, tt.want)
+			}
+		})
+	}
+
+	if got := (PageParams{Before: "x"}).orderBy(false, "rank DESC", "username ASC"); got != "\n\t\tORDER BY rank ASC, username DESC" {
+		t.Errorf("orderBy() with mixed directions = %q", got)
+	}
+}
+
+func TestPageParamsLimit(t *testing.T) {
+	clause, args := PageParams{Limit: 10}.limit([]interface{}{"john"})
+	if clause != "\n\t\tLIMIT $2" {
+		t.Errorf("limit() clause = %q", clause)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"john", 11}) {
+		t.Errorf("limit() args = %v", args)
+	}
+}
+
+func TestPageParamsTrim(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      PageParams
+		items       []int
+		want        []int
+		wantHasMore bool
+	}{
+		{"less than limit", PageParams{Limit: 3}, []int{1, 2}, []int{1, 2}, false},
+		{"limit", PageParams{Limit: 3}, []int{1, 2, 3}, []int{1, 2, 3}, false},
+		{"more", PageParams{Limit: 3}, []int{1, 2, 3, 4}, []int{1, 2, 3}, true},
+		{"backwards", PageParams{Limit: 3, After: "x"}, []int{1, 2, 3, 4}, []int{3, 2, 1}, true},
+		{"empty backwards", PageParams{Limit: 3, After: "x"}, []int{}, []int{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, hasMore := tt.params.trim(true, tt.items)
+			if got := tt.items[:n]; !reflect.DeepEqual(got, tt.want) || hasMore != tt.wantHasMore {
+				t.Errorf("trim() = %v, %t, want %v, %t", got, hasMore, tt.want, tt.wantHasMore)
+			}
+		})
+	}
+}
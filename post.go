@@ -1,33 +1,57 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/go-chi/chi"
 )
 
 // Post model
+// QuoteOfID is set on quote posts; QuoteOf, the quoted post, is only loaded by getPost.
 type Post struct {
-	ID            string    `json:"id"`
-	Content       string    `json:"content"`
-	SpoilerOf     *string   `json:"spoilerOf"`
-	LikesCount    int       `json:"likesCount"`
-	CommentsCount int       `json:"commentsCount"`
-	CreatedAt     time.Time `json:"createdAt"`
-	UserID        string    `json:"-"`
-	User          *User     `json:"user,omitempty"`
-	Mine          bool      `json:"mine"`
-	Liked         bool      `json:"liked"`
-	Subscribed    bool      `json:"subscribed"`
+	ID            string     `json:"id"`
+	Cursor        string     `json:"cursor,omitempty"`
+	Content       string     `json:"content"`
+	SpoilerOf     *string    `json:"spoilerOf"`
+	LikesCount    int        `json:"likesCount"`
+	CommentsCount int        `json:"commentsCount"`
+	RepostsCount  int        `json:"repostsCount"`
+	QuotesCount   int        `json:"quotesCount"`
+	QuoteOfID     *string    `json:"quoteOfId"`
+	QuoteOf       *Post      `json:"quoteOf,omitempty"`
+	Media         []Media    `json:"media,omitempty"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	EditedAt      *time.Time `json:"editedAt"`
+	UserID        string     `json:"-"`
+	User          *User      `json:"user,omitempty"`
+	Mine          bool       `json:"mine"`
+	Liked         bool       `json:"liked"`
+	Reposted      bool       `json:"reposted"`
+	Subscribed    bool       `json:"subscribed"`
 }
 
-// CreatePostInput request body
+// CreatePostInput request body.
+// Set quoteOfId to quote another post.
+// Media are the ids of images uploaded to /api/media, up to four.
 type CreatePostInput struct {
+	Content   string           `json:"content"`
+	SpoilerOf *string          `json:"spoilerOf,omitempty"`
+	QuoteOfID *string          `json:"quoteOfId,omitempty"`
+	Media     []PostMediaInput `json:"media,omitempty"`
+}
+
+// UpdatePostInput request body.
+// Both fields replace the current ones, so leave spoilerOf out to unmark a spoiler.
+type UpdatePostInput struct {
 	Content   string  `json:"content"`
 	SpoilerOf *string `json:"spoilerOf,omitempty"`
 }
@@ -38,10 +62,96 @@ type TogglePostLikePayload struct {
 	LikesCount int  `json:"likesCount"`
 }
 
+// TogglePostRepostPayload response body
+type TogglePostRepostPayload struct {
+	Reposted     bool `json:"reposted"`
+	RepostsCount int  `json:"repostsCount"`
+}
+
+// PostCounters realtime event sent to the post topic
+// when one of its counters changes.
+type PostCounters struct {
+	PostID        string `json:"postId"`
+	LikesCount    int    `json:"likesCount"`
+	CommentsCount int    `json:"commentsCount"`
+	RepostsCount  int    `json:"repostsCount"`
+	QuotesCount   int    `json:"quotesCount"`
+}
+
+// PostDeletion realtime event sent as "post_deleted"
+// to the post topic and to the feeds that had it.
+type PostDeletion struct {
+	PostID string `json:"postId"`
+}
+
+var (
+	errForbidden          = errors.New("forbidden")
+	errQuotedPostNotFound = errors.New("quoted post not found")
+)
+
+func postTopic(postID string) string {
+	return "post:" + postID
+}
+
+const (
+	postContentMaxLength = 480
+	spoilerOfMaxLength   = 128
+)
+
 // Validate user input
 func (input *CreatePostInput) Validate() map[string]string {
-	// TODO: actual validation
-	return nil
+	errs := make(map[string]string)
+
+	input.Content = strings.TrimSpace(input.Content)
+	if input.Content == "" {
+		errs["content"] = "Content required"
+	} else if utf8.RuneCountInString(input.Content) > postContentMaxLength {
+		errs["content"] = fmt.Sprintf("Content too long. Max %d characters", postContentMaxLength)
+	}
+
+	if input.SpoilerOf != nil {
+		spoilerOf := strings.TrimSpace(*input.SpoilerOf)
+		if spoilerOf == "" {
+			errs["spoilerOf"] = "Spoiler of required"
+		} else if utf8.RuneCountInString(spoilerOf) > spoilerOfMaxLength {
+			errs["spoilerOf"] = fmt.Sprintf("Spoiler of too long. Max %d characters", spoilerOfMaxLength)
+		}
+		input.SpoilerOf = &spoilerOf
+	}
+
+	if len(input.Media) > postMediaMaxCount {
+		errs["media"] = fmt.Sprintf("Too many media. Max %d", postMediaMaxCount)
+	}
+	seen := map[string]bool{}
+	for i, media := range input.Media {
+		if seen[media.ID] {
+			errs["media"] = "Duplicated media"
+		}
+		seen[media.ID] = true
+
+		if media.AltText != nil {
+			altText := strings.TrimSpace(*media.AltText)
+			if utf8.RuneCountInString(altText) > altTextMaxLength {
+				errs["media"] = fmt.Sprintf("Alt text too long. Max %d characters", altTextMaxLength)
+			}
+			if altText == "" {
+				input.Media[i].AltText = nil
+			} else {
+				input.Media[i].AltText = &altText
+			}
+		}
+	}
+
+	return errs
+}
+
+// Validate user input
+func (input *UpdatePostInput) Validate() map[string]string {
+	in := CreatePostInput{Content: input.Content, SpoilerOf: input.SpoilerOf}
+	errs := in.Validate()
+	input.Content = in.Content
+	input.SpoilerOf = in.SpoilerOf
+	return errs
 }
 
 func createPost(w http.ResponseWriter, r *http.Request) {
@@ -59,19 +169,49 @@ func createPost(w http.ResponseWriter, r *http.Request) {
 
 	content := input.Content
 	spoilerOf := input.SpoilerOf
+	quoteOfID := input.QuoteOfID
 
 	ctx := r.Context()
 	authUser := ctx.Value(keyAuthUser).(User)
 
 	var post Post
 	var feedItem FeedItem
+	var quotedCounters PostCounters
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if quoteOfID != nil {
+			quotedCounters.PostID = *quoteOfID
+			if err := tx.QueryRow(`
+				UPDATE posts SET quotes_count = quotes_count + 1
+				WHERE id = $1
+				RETURNING likes_count, comments_count, reposts_count, quotes_count
+			`, *quoteOfID).Scan(
+				&quotedCounters.LikesCount,
+				&quotedCounters.CommentsCount,
+				&quotedCounters.RepostsCount,
+				&quotedCounters.QuotesCount,
+			); err == sql.ErrNoRows {
+				return errQuotedPostNotFound
+			} else if err != nil {
+				return err
+			}
+		}
+
 		if err := tx.QueryRow(`
-			INSERT INTO posts (content, spoiler_of, user_id) VALUES ($1, $2, $3)
+			INSERT INTO posts (content, spoiler_of, quote_of_id, user_id) VALUES ($1, $2, $3, $4)
 			RETURNING id, created_at
-		`, content, spoilerOf, authUser.ID).Scan(&post.ID, &post.CreatedAt); err != nil {
+		`, content, spoilerOf, quoteOfID, authUser.ID).Scan(&post.ID, &post.CreatedAt); err != nil {
+			return err
+		}
+
+		if err := setPostTags(tx, post.ID, content, post.CreatedAt); err != nil {
+			return err
+		}
+
+		media, err := attachPostMedia(tx, post.ID, authUser.ID, input.Media)
+		if err != nil {
 			return err
 		}
+		post.Media = media
 
 		if _, err := tx.Exec(`
 			INSERT INTO subscriptions (user_id, post_id) VALUES ($1, $2)
@@ -80,31 +220,70 @@ func createPost(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		return tx.QueryRow(`
-			INSERT INTO feed (user_id, post_id) VALUES ($1, $2)
+		if err := tx.QueryRow(`
+			INSERT INTO feed (user_id, post_id, sorted_at) VALUES ($1, $2, $3)
 			RETURNING id
-		`, authUser.ID, post.ID).Scan(&feedItem.ID)
-	}); err != nil {
+		`, authUser.ID, post.ID, post.CreatedAt).Scan(&feedItem.ID); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "feed_fanout", postJobPayload{post.ID}); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "post_mention_notifications", postJobPayload{post.ID}); err != nil {
+			return err
+		}
+
+		if quoteOfID == nil {
+			return nil
+		}
+
+		return enqueueJob(tx, "quote_notification", postJobPayload{post.ID})
+	}); err == errQuotedPostNotFound {
+		respondJSON(w, map[string]string{
+			"quoteOfId": "Quoted post not found",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err == errMediaNotFound {
+		respondJSON(w, map[string]string{
+			"media": "Media not found",
+		}, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
 		respondError(w, fmt.Errorf("could not create post: %v", err))
 		return
 	}
 
 	post.Content = content
 	post.SpoilerOf = spoilerOf
+	post.QuoteOfID = quoteOfID
 	post.UserID = authUser.ID
 	post.User = &authUser
 	post.Mine = true
 	post.Subscribed = true
+	feedItem.Cursor = encodeCursor(post.CreatedAt, feedItem.ID)
 	feedItem.Post = post
 
-	go feedFanout(post)
-	go postMentionNotificationFanout(post)
+	jobWorkers.notify()
+
+	if quoteOfID != nil {
+		broker.publish(postTopic(*quoteOfID), "", authUser.ID, quotedCounters)
+	}
 
 	respondJSON(w, feedItem, http.StatusCreated)
 }
 
-// TODO: add pagination
 func getPosts(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs == nil {
+		errs = page.cursorErrs()
+	}
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx := r.Context()
 	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
 	username := chi.URLParam(r, "username")
@@ -116,12 +295,17 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 			posts.spoiler_of,
 			posts.likes_count,
 			posts.comments_count,
-			posts.created_at`
+			posts.reposts_count,
+			posts.quotes_count,
+			posts.quote_of_id,
+			posts.created_at,
+			posts.edited_at`
 	args := []interface{}{username}
 	if authenticated {
 		query += `,
 			posts.user_id = $2 AS mine,
 			likes.user_id IS NOT NULL AS liked,
+			reposts.user_id IS NOT NULL AS reposted,
 			subscriptions.user_id IS NOT NULL AS subscribed`
 		args = append(args, authUserID)
 	}
@@ -132,6 +316,9 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 			LEFT JOIN post_likes AS likes
 				ON likes.user_id = $2
 				AND likes.post_id = posts.id
+			LEFT JOIN reposts
+				ON reposts.user_id = $2
+				AND reposts.post_id = posts.id
 			LEFT JOIN subscriptions
 				ON subscriptions.user_id = $2
 				AND subscriptions.post_id = posts.id`
@@ -139,8 +326,12 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 	query += `
 		WHERE posts.user_id = (
 			SELECT id FROM users WHERE username = $1
-		)
-		ORDER BY posts.created_at DESC`
+		)`
+	conds, args := page.cursorConds("posts.created_at", "posts.id", args)
+	query += conds
+	query += page.orderBy(true, "posts.created_at DESC", "posts.id DESC")
+	limit, args := page.limit(args)
+	query += limit
 
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -149,7 +340,7 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	posts := make([]Post, 0)
+	posts := make([]Post, 0, page.Limit+1)
 	for rows.Next() {
 		var post Post
 		dest := []interface{}{
@@ -158,12 +349,17 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 			&post.SpoilerOf,
 			&post.LikesCount,
 			&post.CommentsCount,
+			&post.RepostsCount,
+			&post.QuotesCount,
+			&post.QuoteOfID,
 			&post.CreatedAt,
+			&post.EditedAt,
 		}
 		if authenticated {
 			dest = append(dest,
 				&post.Mine,
 				&post.Liked,
+				&post.Reposted,
 				&post.Subscribed,
 			)
 		}
@@ -173,6 +369,7 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		post.Cursor = encodeCursor(post.CreatedAt, post.ID)
 		posts = append(posts, post)
 	}
 	if err = rows.Err(); err != nil {
@@ -180,7 +377,15 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondJSON(w, posts, http.StatusOK)
+	n, hasMore := page.trim(true, posts)
+	posts = posts[:n]
+
+	if err = withPostsMedia(ctx, postPointers(posts)); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondJSON(w, Page{posts, hasMore}, http.StatusOK)
 }
 
 func getPost(w http.ResponseWriter, r *http.Request) {
@@ -194,7 +399,11 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 			posts.spoiler_of,
 			posts.likes_count,
 			posts.comments_count,
+			posts.reposts_count,
+			posts.quotes_count,
+			posts.quote_of_id,
 			posts.created_at,
+			posts.edited_at,
 			users.username,
 			users.avatar_url`
 	args := []interface{}{postID}
@@ -205,6 +414,10 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 				SELECT 1 FROM post_likes
 				WHERE user_id = $2 AND post_id = $1
 			) AS liked,
+			EXISTS (
+				SELECT 1 FROM reposts
+				WHERE user_id = $2 AND post_id = $1
+			) AS reposted,
 			EXISTS (
 				SELECT 1 FROM subscriptions
 				WHERE user_id = $2 AND post_id = $1
@@ -222,7 +435,11 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 		&post.SpoilerOf,
 		&post.LikesCount,
 		&post.CommentsCount,
+		&post.RepostsCount,
+		&post.QuotesCount,
+		&post.QuoteOfID,
 		&post.CreatedAt,
+		&post.EditedAt,
 		&user.Username,
 		&user.AvatarURL,
 	}
@@ -230,6 +447,7 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 		dest = append(dest,
 			&post.Mine,
 			&post.Liked,
+			&post.Reposted,
 			&post.Subscribed,
 		)
 	}
@@ -247,18 +465,388 @@ func getPost(w http.ResponseWriter, r *http.Request) {
 	post.ID = postID
 	post.User = &user
 
+	if err := withPostsMedia(ctx, []*Post{&post}); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	// The quoted post may have been deleted since, then QuoteOf stays nil.
+	if post.QuoteOfID != nil {
+		quoteOf, err := postByID(ctx, *post.QuoteOfID)
+		if err != nil && err != sql.ErrNoRows {
+			respondError(w, fmt.Errorf("could not get quoted post: %v", err))
+			return
+		} else if err == nil {
+			post.QuoteOf = &quoteOf
+		}
+	}
+
 	respondJSON(w, post, http.StatusOK)
 }
 
+// updatePost changes the content of the auth user's post,
+// keeping the previous one as a revision.
+// Users mentioned for the first time get notified.
+func updatePost(w http.ResponseWriter, r *http.Request) {
+	var input UpdatePostInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if errs := input.Validate(); len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	content := input.Content
+	spoilerOf := input.SpoilerOf
+
+	ctx := r.Context()
+	authUser := ctx.Value(keyAuthUser).(User)
+	postID := chi.URLParam(r, "post_id")
+
+	var post Post
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		var userID string
+		if err := tx.QueryRow(`
+			SELECT user_id, content, spoiler_of, created_at, edited_at
+			FROM posts WHERE id = $1
+		`, postID).Scan(
+			&userID,
+			&post.Content,
+			&post.SpoilerOf,
+			&post.CreatedAt,
+			&post.EditedAt,
+		); err != nil {
+			return err
+		}
+
+		if userID != authUser.ID {
+			return errForbidden
+		}
+
+		changed := post.Content != content ||
+			(post.SpoilerOf == nil) != (spoilerOf == nil) ||
+			post.SpoilerOf != nil && *post.SpoilerOf != *spoilerOf
+
+		if changed {
+			// The revision keeps the time its content was written.
+			revisedAt := post.CreatedAt
+			if post.EditedAt != nil {
+				revisedAt = *post.EditedAt
+			}
+			if _, err := tx.Exec(`
+				INSERT INTO post_revisions (post_id, content, spoiler_of, created_at)
+				VALUES ($1, $2, $3, $4)
+				RETURNING NOTHING
+			`, postID, post.Content, post.SpoilerOf, revisedAt); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.QueryRow(`
+			UPDATE posts SET
+				content = $2,
+				spoiler_of = $3,
+				edited_at = CASE WHEN $5 THEN now() ELSE edited_at END
+			WHERE id = $1
+			RETURNING
+				likes_count,
+				comments_count,
+				reposts_count,
+				quotes_count,
+				quote_of_id,
+				edited_at,
+				EXISTS (
+					SELECT 1 FROM post_likes
+					WHERE user_id = $4 AND post_id = $1
+				),
+				EXISTS (
+					SELECT 1 FROM reposts
+					WHERE user_id = $4 AND post_id = $1
+				),
+				EXISTS (
+					SELECT 1 FROM subscriptions
+					WHERE user_id = $4 AND post_id = $1
+				)
+		`, postID, content, spoilerOf, authUser.ID, changed).Scan(
+			&post.LikesCount,
+			&post.CommentsCount,
+			&post.RepostsCount,
+			&post.QuotesCount,
+			&post.QuoteOfID,
+			&post.EditedAt,
+			&post.Liked,
+			&post.Reposted,
+			&post.Subscribed,
+		); err != nil {
+			return err
+		}
+
+		if !changed {
+			return nil
+		}
+
+		if err := setPostTags(tx, postID, content, post.CreatedAt); err != nil {
+			return err
+		}
+
+		return enqueueJob(tx, "post_mention_notifications", postJobPayload{postID})
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errForbidden {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not update post: %v", err))
+		return
+	}
+
+	post.ID = postID
+	post.Content = content
+	post.SpoilerOf = spoilerOf
+	post.UserID = authUser.ID
+	post.User = &authUser
+	post.Mine = true
+
+	jobWorkers.notify()
+
+	if err := withPostsMedia(ctx, []*Post{&post}); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondJSON(w, post, http.StatusOK)
+}
+
+// deletePost removes the post of the auth user along with its revisions, tags, media,
+// comments, likes, reposts, subscriptions, feed items and notifications.
+// Quotes of it are kept.
+func deletePost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	postID := chi.URLParam(r, "post_id")
+
+	var feedUserIDs, mediaFilenames []string
+	var quoteOfID *string
+	var quotedCounters PostCounters
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		feedUserIDs = nil
+		mediaFilenames = nil
+
+		var userID string
+		var fanoutOnRead bool
+		if err := tx.QueryRow("SELECT user_id, quote_of_id, fanout_on_read FROM posts WHERE id = $1", postID).
+			Scan(&userID, &quoteOfID, &fanoutOnRead); err != nil {
+			return err
+		}
+
+		if userID != authUserID {
+			return errForbidden
+		}
+
+		if fanoutOnRead {
+			if err := enqueueJob(tx, "post_deletion_fanout", postDeletionJobPayload{userID, postID}); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM notifications
+			WHERE target_id = $1 AND verb IN ('comment', 'comment_mention', 'comment_reply')
+				OR object_id = $1 AND verb IN ('post_mention', 'repost', 'quote')
+		`, postID); err != nil {
+			return err
+		}
+
+		if quoteOfID != nil {
+			quotedCounters.PostID = *quoteOfID
+			if err := tx.QueryRow(`
+				UPDATE posts SET quotes_count = quotes_count - 1
+				WHERE id = $1
+				RETURNING likes_count, comments_count, reposts_count, quotes_count
+			`, *quoteOfID).Scan(
+				&quotedCounters.LikesCount,
+				&quotedCounters.CommentsCount,
+				&quotedCounters.RepostsCount,
+				&quotedCounters.QuotesCount,
+			); err == sql.ErrNoRows {
+				// The quoted post was deleted first.
+				quoteOfID = nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(`
+			DELETE FROM comment_likes
+			WHERE comment_id IN (SELECT id FROM comments WHERE post_id = $1)
+		`, postID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM post_revisions WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM post_tags WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		mediaRows, err := tx.Query("DELETE FROM media WHERE post_id = $1 RETURNING filename", postID)
+		if err != nil {
+			return err
+		}
+		defer mediaRows.Close()
+
+		for mediaRows.Next() {
+			var filename string
+			if err = mediaRows.Scan(&filename); err != nil {
+				return err
+			}
+			mediaFilenames = append(mediaFilenames, filename)
+		}
+		if err = mediaRows.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM comments WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM post_likes WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM reposts WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM subscriptions WHERE post_id = $1", postID); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("DELETE FROM feed WHERE post_id = $1 RETURNING user_id", postID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var feedUserID string
+			if err = rows.Scan(&feedUserID); err != nil {
+				return err
+			}
+			feedUserIDs = append(feedUserIDs, feedUserID)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM posts WHERE id = $1", postID)
+		return err
+	}); err == sql.ErrNoRows {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	} else if err == errForbidden {
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	} else if err != nil {
+		respondError(w, fmt.Errorf("could not delete post: %v", err))
+		return
+	}
+
+	jobWorkers.notify()
+	removeMediaFiles(ctx, mediaFilenames)
+
+	deletion := PostDeletion{postID}
+	broker.publishEvent(postTopic(postID), "post_deleted", authUserID, deletion)
+	for _, userID := range feedUserIDs {
+		broker.publishEvent(feedTopic(userID), "post_deleted", authUserID, deletion)
+	}
+	if quoteOfID != nil {
+		broker.publish(postTopic(*quoteOfID), "", authUserID, quotedCounters)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postByID loads a post along with its author.
+func postByID(ctx context.Context, postID string) (Post, error) {
+	var user User
+	var post Post
+	if err := db.QueryRowContext(ctx, `
+		SELECT
+			posts.content,
+			posts.spoiler_of,
+			posts.likes_count,
+			posts.comments_count,
+			posts.reposts_count,
+			posts.quotes_count,
+			posts.quote_of_id,
+			posts.created_at,
+			posts.edited_at,
+			posts.user_id,
+			users.username,
+			users.avatar_url
+		FROM posts
+		INNER JOIN users ON posts.user_id = users.id
+		WHERE posts.id = $1
+	`, postID).Scan(
+		&post.Content,
+		&post.SpoilerOf,
+		&post.LikesCount,
+		&post.CommentsCount,
+		&post.RepostsCount,
+		&post.QuotesCount,
+		&post.QuoteOfID,
+		&post.CreatedAt,
+		&post.EditedAt,
+		&post.UserID,
+		&user.Username,
+		&user.AvatarURL,
+	); err != nil {
+		return post, err
+	}
+
+	user.ID = post.UserID
+	post.ID = postID
+	post.User = &user
+
+	if err := withPostsMedia(ctx, []*Post{&post}); err != nil {
+		return post, err
+	}
+
+	return post, nil
+}
+
+func postPointers(posts []Post) []*Post {
+	pp := make([]*Post, len(posts))
+	for i := range posts {
+		pp[i] = &posts[i]
+	}
+	return pp
+}
+
 func togglePostLike(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	authUserID := ctx.Value(keyAuthUserID).(string)
 	postID := chi.URLParam(r, "post_id")
 
 	var liked bool
-	var likesCount int
+	counters := PostCounters{PostID: postID}
 	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
-
 		if err := tx.QueryRow(`SELECT EXISTS (
 			SELECT 1 FROM post_likes
 			WHERE user_id = $1 AND post_id = $2
@@ -278,8 +866,13 @@ func togglePostLike(w http.ResponseWriter, r *http.Request) {
 			return tx.QueryRow(`
 				UPDATE posts SET likes_count = likes_count - 1
 				WHERE id = $1
-				RETURNING likes_count
-			`, postID).Scan(&likesCount)
+				RETURNING likes_count, comments_count, reposts_count, quotes_count
+			`, postID).Scan(
+				&counters.LikesCount,
+				&counters.CommentsCount,
+				&counters.RepostsCount,
+				&counters.QuotesCount,
+			)
 		}
 
 		if _, err := tx.Exec(`
@@ -292,8 +885,13 @@ func togglePostLike(w http.ResponseWriter, r *http.Request) {
 		return tx.QueryRow(`
 			UPDATE posts SET likes_count = likes_count + 1
 			WHERE id = $1
-			RETURNING likes_count
-		`, postID).Scan(&likesCount)
+			RETURNING likes_count, comments_count, reposts_count, quotes_count
+		`, postID).Scan(
+			&counters.LikesCount,
+			&counters.CommentsCount,
+			&counters.RepostsCount,
+			&counters.QuotesCount,
+		)
 	}); err != nil {
 		respondError(w, fmt.Errorf("could not toggle post like: %v", err))
 		return
@@ -301,7 +899,90 @@ func togglePostLike(w http.ResponseWriter, r *http.Request) {
 
 	liked = !liked
 
-	respondJSON(w, TogglePostLikePayload{liked, likesCount}, http.StatusOK)
+	broker.publish(postTopic(postID), "", authUserID, counters)
+
+	respondJSON(w, TogglePostLikePayload{liked, counters.LikesCount}, http.StatusOK)
+}
+
+// togglePostRepost reposts the post into the feed of the auth user's followers,
+// or undoes it.
+func togglePostRepost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID := ctx.Value(keyAuthUserID).(string)
+	postID := chi.URLParam(r, "post_id")
+
+	var reposted bool
+	counters := PostCounters{PostID: postID}
+	if err := crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRow(`SELECT EXISTS (
+			SELECT 1 FROM reposts
+			WHERE user_id = $1 AND post_id = $2
+		)`, authUserID, postID).Scan(&reposted); err != nil {
+			return err
+		}
+
+		if reposted {
+			if _, err := tx.Exec(`
+				DELETE FROM reposts
+				WHERE user_id = $1 AND post_id = $2
+				RETURNING NOTHING
+			`, authUserID, postID); err != nil {
+				return err
+			}
+
+			if err := tx.QueryRow(`
+				UPDATE posts SET reposts_count = reposts_count - 1
+				WHERE id = $1
+				RETURNING likes_count, comments_count, reposts_count, quotes_count
+			`, postID).Scan(
+				&counters.LikesCount,
+				&counters.CommentsCount,
+				&counters.RepostsCount,
+				&counters.QuotesCount,
+			); err != nil {
+				return err
+			}
+
+			return enqueueJob(tx, "repost_prune", repostJobPayload{authUserID, postID})
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO reposts (user_id, post_id) VALUES ($1, $2)
+			RETURNING NOTHING
+		`, authUserID, postID); err != nil {
+			return err
+		}
+
+		if err := tx.QueryRow(`
+			UPDATE posts SET reposts_count = reposts_count + 1
+			WHERE id = $1
+			RETURNING likes_count, comments_count, reposts_count, quotes_count
+		`, postID).Scan(
+			&counters.LikesCount,
+			&counters.CommentsCount,
+			&counters.RepostsCount,
+			&counters.QuotesCount,
+		); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "repost_fanout", repostJobPayload{authUserID, postID}); err != nil {
+			return err
+		}
+
+		return enqueueJob(tx, "repost_notification", repostJobPayload{authUserID, postID})
+	}); err != nil {
+		respondError(w, fmt.Errorf("could not toggle post repost: %v", err))
+		return
+	}
+
+	reposted = !reposted
+
+	jobWorkers.notify()
+
+	broker.publish(postTopic(postID), "", authUserID, counters)
+
+	respondJSON(w, TogglePostRepostPayload{reposted, counters.RepostsCount}, http.StatusOK)
 }
 
 func toggleSubscription(w http.ResponseWriter, r *http.Request) {
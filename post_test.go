@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestCreatePostInputValidate(t *testing.T) {
+	tooLongContent := fmt.Sprintf("Content too long. Max %d characters", postContentMaxLength)
+	tooLongSpoiler := fmt.Sprintf("Spoiler of too long. Max %d characters", spoilerOfMaxLength)
+	tooLongAltText := fmt.Sprintf("Alt text too long. Max %d characters", altTextMaxLength)
+	tests := []struct {
+		name  string
+		input CreatePostInput
+		want  map[string]string
+	}{
+		{"valid", CreatePostInput{Content: "hello"}, map[string]string{}},
+		{"empty content", CreatePostInput{Content: ""}, map[string]string{"content": "Content required"}},
+		{"blank content", CreatePostInput{Content: " \n\t"}, map[string]string{"content": "Content required"}},
+		{"content max length", CreatePostInput{Content: strings.Repeat("a", postContentMaxLength)}, map[string]string{}},
+		{"content max length in runes", CreatePostInput{Content: strings.Repeat("ñ", postContentMaxLength)}, map[string]string{}},
+		{"content too long", CreatePostInput{Content: strings.Repeat("a", postContentMaxLength+1)}, map[string]string{"content": tooLongContent}},
+		{"spoiler", CreatePostInput{Content: "hello", SpoilerOf: strPtr("movie")}, map[string]string{}},
+		{"blank spoiler", CreatePostInput{Content: "hello", SpoilerOf: strPtr("  ")}, map[string]string{"spoilerOf": "Spoiler of required"}},
+		{"spoiler max length", CreatePostInput{Content: "hello", SpoilerOf: strPtr(strings.Repeat("a", spoilerOfMaxLength))}, map[string]string{}},
+		{"spoiler too long", CreatePostInput{Content: "hello", SpoilerOf: strPtr(strings.Repeat("a", spoilerOfMaxLength+1))}, map[string]string{"spoilerOf": tooLongSpoiler}},
+		{"max media", CreatePostInput{Content: "hello", Media: []PostMediaInput{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}}}, map[string]string{}},
+		{"too many media", CreatePostInput{Content: "hello", Media: []PostMediaInput{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}, {ID: "5"}}},
+			map[string]string{"media": fmt.Sprintf("Too many media. Max %d", postMediaMaxCount)}},
+		{"duplicated media", CreatePostInput{Content: "hello", Media: []PostMediaInput{{ID: "1"}, {ID: "1"}}}, map[string]string{"media": "Duplicated media"}},
+		{"alt text max length", CreatePostInput{Content: "hello", Media: []PostMediaInput{{ID: "1", AltText: strPtr(strings.Repeat("a", altTextMaxLength))}}}, map[string]string{}},
+		{"alt text too long", CreatePostInput{Content: "hello", Media: []PostMediaInput{{ID: "1", AltText: strPtr(strings.Repeat("a", altTextMaxLength+1))}}},
+			map[string]string{"media": tooLongAltText}},
+		{"every field", CreatePostInput{Content: "", SpoilerOf: strPtr(""), Media: []PostMediaInput{{ID: "1"}, {ID: "1"}}},
+			map[string]string{"content": "Content required", "spoilerOf": "Spoiler of required", "media": "Duplicated media"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.Validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePostInputValidateTrims(t *testing.T) {
+	input := CreatePostInput{
+		Content:   "  hello  ",
+		SpoilerOf: strPtr(" movie "),
+		Media:     []PostMediaInput{{ID: "1", AltText: strPtr(" a cat ")}, {ID: "2", AltText: strPtr("  ")}},
+	}
+	if errs := input.Validate(); len(errs) != 0 {
+		t.Fatalf("Validate() = %v, want no errors", errs)
+	}
+	if input.Content != "hello" || *input.SpoilerOf != "movie" {
+		t.Errorf("input not trimmed: %q, %q", input.Content, *input.SpoilerOf)
+	}
+	if *input.Media[0].AltText != "a cat" || input.Media[1].AltText != nil {
+		t.Errorf("alt texts not trimmed: %v, %v", input.Media[0].AltText, input.Media[1].AltText)
+	}
+}
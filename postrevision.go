@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// PostRevision model. A previous content of an edited post,
+// CreatedAt being when that content was written.
+type PostRevision struct {
+	ID        string    `json:"id"`
+	Cursor    string    `json:"cursor"`
+	Content   string    `json:"content"`
+	SpoilerOf *string   `json:"spoilerOf"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func getPostRevisions(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs == nil {
+		errs = page.cursorErrs()
+	}
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	postID := chi.URLParam(r, "post_id")
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM posts WHERE id = $1
+	)`, postID).Scan(&exists); err != nil {
+		respondError(w, fmt.Errorf("could not query post existence: %v", err))
+		return
+	}
+
+	if !exists {
+		http.Error(w,
+			http.StatusText(http.StatusNotFound),
+			http.StatusNotFound)
+		return
+	}
+
+	query := `
+		SELECT id, content, spoiler_of, created_at
+		FROM post_revisions
+		WHERE post_id = $1`
+	args := []interface{}{postID}
+	conds, args := page.cursorConds("created_at", "id", args)
+	query += conds
+	query += page.orderBy(true, "created_at DESC", "id DESC")
+	limit, args := page.limit(args)
+	query += limit
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query post revisions: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	revisions := make([]PostRevision, 0, page.Limit+1)
+	for rows.Next() {
+		var revision PostRevision
+		if err = rows.Scan(
+			&revision.ID,
+			&revision.Content,
+			&revision.SpoilerOf,
+			&revision.CreatedAt,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan post revision: %v", err))
+			return
+		}
+
+		revision.Cursor = encodeCursor(revision.CreatedAt, revision.ID)
+		revisions = append(revisions, revision)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over post revisions: %v", err))
+		return
+	}
+
+	n, hasMore := page.trim(true, revisions)
+	revisions = revisions[:n]
+
+	respondJSON(w, Page{revisions, hasMore}, http.StatusOK)
+}
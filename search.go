@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// SearchResult model. Either a post or a comment.
+// Cursor is an opaque token to pass as before or after when paginating.
+type SearchResult struct {
+	Cursor  string   `json:"cursor"`
+	Post    *Post    `json:"post,omitempty"`
+	Comment *Comment `json:"comment,omitempty"`
+}
+
+// searchQuery is a parsed search.
+// Terms are tsquery operands; all of them have to match.
+type searchQuery struct {
+	terms    []string
+	username string
+	tags     []string
+}
+
+// parseSearchQuery parses words, "quoted phrases",
+// from:username and #tag operators.
+func parseSearchQuery(q string) searchQuery {
+	var sq searchQuery
+	for {
+		q = strings.TrimLeftFunc(q, unicode.IsSpace)
+		if q == "" {
+			break
+		}
+
+		if q[0] == '"' {
+			phrase := q[1:]
+			q = ""
+			if end := strings.IndexByte(phrase, '"'); end != -1 {
+				phrase, q = phrase[:end], phrase[end+1:]
+			}
+			if words := searchWords(phrase); len(words) != 0 {
+				sq.terms = append(sq.terms, strings.Join(words, " <-> "))
+			}
+			continue
+		}
+
+		token := q
+		q = ""
+		if end := strings.IndexFunc(token, unicode.IsSpace); end != -1 {
+			token, q = token[:end], token[end:]
+		}
+
+		switch {
+		case strings.HasPrefix(strings.ToLower(token), "from:"):
+			sq.username = strings.TrimPrefix(token[len("from:"):], "@")
+		case strings.HasPrefix(token, "#"):
+			if tag := normalizeTag(token); tag != "" {
+				sq.tags = append(sq.tags, tag)
+			}
+		default:
+			if words := searchWords(token); len(words) != 0 {
+				sq.terms = append(sq.terms, strings.Join(words, " <-> "))
+			}
+		}
+	}
+	return sq
+}
+
+// searchWords splits s into lowercased words of letters and digits,
+// so they're safe to use in a tsquery.
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// search looks for posts and comments, the best matches first.
+// Posts are filtered by tag through post_tags;
+// comments have no tags, so for them tags are searched as words.
+func search(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, errs := parsePageParams(q)
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	sq := parseSearchQuery(q.Get("q"))
+	if len(sq.terms) == 0 && sq.username == "" && len(sq.tags) == 0 {
+		respondJSON(w, map[string]string{
+			"q": "Search query required",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	commentTerms := append([]string{}, sq.terms...)
+	for _, tag := range sq.tags {
+		if words := searchWords(tag); len(words) != 0 {
+			commentTerms = append(commentTerms, strings.Join(words, " <-> "))
+		}
+	}
+
+	var args []interface{}
+	postsRank, commentsRank := "0::FLOAT8", "0::FLOAT8"
+	var postsWhere, commentsWhere []string
+	if len(sq.terms) != 0 {
+		args = append(args, strings.Join(sq.terms, " & "))
+		postsRank = fmt.Sprintf("ts_rank(posts.search_vector, to_tsquery('english', $%d))::FLOAT8", len(args))
+		postsWhere = append(postsWhere, fmt.Sprintf("posts.search_vector @@ to_tsquery('english', $%d)", len(args)))
+	}
+	if len(commentTerms) != 0 {
+		args = append(args, strings.Join(commentTerms, " & "))
+		commentsRank = fmt.Sprintf("ts_rank(comments.search_vector, to_tsquery('english', $%d))::FLOAT8", len(args))
+		commentsWhere = append(commentsWhere, fmt.Sprintf("comments.search_vector @@ to_tsquery('english', $%d)", len(args)))
+	}
+	if sq.username != "" {
+		args = append(args, sq.username)
+		postsWhere = append(postsWhere, fmt.Sprintf("users.username = $%d", len(args)))
+		commentsWhere = append(commentsWhere, fmt.Sprintf("users.username = $%d", len(args)))
+	}
+	if len(sq.tags) != 0 {
+		args = append(args, pq.Array(sq.tags))
+		postsWhere = append(postsWhere, fmt.Sprintf(
+			"$%d::STRING[] <@ ARRAY(SELECT tag FROM post_tags WHERE post_id = posts.id)", len(args)))
+	}
+	if len(commentsWhere) == 0 {
+		// Only tags made of underscores, nothing to search comments for.
+		commentsWhere = append(commentsWhere, "false")
+	}
+
+	query := fmt.Sprintf(`
+		SELECT kind, id, post_id, content, spoiler_of, likes_count, comments_count, rank, created_at, username, avatar_url
+		FROM (
+			SELECT
+				'post' AS kind,
+				posts.id,
+				posts.id AS post_id,
+				posts.content,
+				posts.spoiler_of,
+				posts.likes_count,
+				posts.comments_count,
+				%s AS rank,
+				posts.created_at,
+				users.username,
+				users.avatar_url
+			FROM posts
+			INNER JOIN users ON posts.user_id = users.id
+			WHERE %s
+			UNION ALL
+			SELECT
+				'comment',
+				comments.id,
+				comments.post_id,
+				comments.content,
+				NULL::STRING,
+				comments.likes_count,
+				comments.replies_count,
+				%s,
+				comments.created_at,
+				users.username,
+				users.avatar_url
+			FROM comments
+			INNER JOIN users ON comments.user_id = users.id
+			WHERE %s
+		) AS results`,
+		postsRank, strings.Join(postsWhere, " AND "),
+		commentsRank, strings.Join(commentsWhere, " AND "))
+
+	// Sorted by rank, then newest first. The cursor carries all three.
+	if page.Before != "" {
+		rank, createdAt, id, err := decodeRankCursor(page.Before)
+		if err != nil {
+			respondJSON(w, map[string]string{
+				"before": "Invalid cursor",
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+		args = append(args, rank, createdAt, id)
+		query += fmt.Sprintf(`
+		WHERE (rank, created_at, id) < ($%d, $%d, $%d)`, len(args)-2, len(args)-1, len(args))
+	}
+	if page.After != "" {
+		rank, createdAt, id, err := decodeRankCursor(page.After)
+		if err != nil {
+			respondJSON(w, map[string]string{
+				"after": "Invalid cursor",
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+		args = append(args, rank, createdAt, id)
+		if page.Before != "" {
+			query += `
+			AND`
+		} else {
+			query += `
+		WHERE`
+		}
+		query += fmt.Sprintf(` (rank, created_at, id) > ($%d, $%d, $%d)`, len(args)-2, len(args)-1, len(args))
+	}
+
+	query += page.orderBy(true, "rank DESC", "created_at DESC", "id DESC")
+	limit, args := page.limit(args)
+	query += limit
+
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query search: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0, page.Limit+1)
+	for rows.Next() {
+		var kind, id, postID, content string
+		var spoilerOf *string
+		var likesCount, commentsCount int
+		var rank float64
+		var createdAt time.Time
+		var user User
+		if err = rows.Scan(
+			&kind,
+			&id,
+			&postID,
+			&content,
+			&spoilerOf,
+			&likesCount,
+			&commentsCount,
+			&rank,
+			&createdAt,
+			&user.Username,
+			&user.AvatarURL,
+		); err != nil {
+			respondError(w, fmt.Errorf("could not scan search result: %v", err))
+			return
+		}
+
+		result := SearchResult{Cursor: encodeRankCursor(rank, createdAt, id)}
+		if kind == "post" {
+			result.Post = &Post{
+				ID:            id,
+				Content:       content,
+				SpoilerOf:     spoilerOf,
+				LikesCount:    likesCount,
+				CommentsCount: commentsCount,
+				CreatedAt:     createdAt,
+				User:          &user,
+			}
+		} else {
+			result.Comment = &Comment{
+				ID:           id,
+				Content:      content,
+				LikesCount:   likesCount,
+				RepliesCount: commentsCount,
+				CreatedAt:    createdAt,
+				PostID:       postID,
+				User:         user,
+			}
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over search results: %v", err))
+		return
+	}
+
+	n, hasMore := page.trim(true, results)
+	results = results[:n]
+
+	respondJSON(w, Page{results, hasMore}, http.StatusOK)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		q    string
+		want searchQuery
+	}{
+		{"empty", "", searchQuery{}},
+		{"blank", "  \t\n", searchQuery{}},
+		{"words", "Hello  World", searchQuery{terms: []string{"hello", "world"}}},
+		{"phrase", `"hello world" foo`, searchQuery{terms: []string{"hello <-> world", "foo"}}},
+		{"unterminated quote", `foo "hello world`, searchQuery{terms: []string{"foo", "hello <-> world"}}},
+		{"empty phrase", `"" "  "`, searchQuery{}},
+		{"from", "from:john go", searchQuery{terms: []string{"go"}, username: "john"}},
+		{"from with at", "from:@john", searchQuery{username: "john"}},
+		{"from uppercase", "FROM:John", searchQuery{username: "John"}},
+		{"last from wins", "from:john from:jane", searchQuery{username: "jane"}},
+		{"tag", "#Go #golang", searchQuery{tags: []string{"go", "golang"}}},
+		{"tag normalized to empty", "#go-lang #", searchQuery{}},
+		{"tag underscore", "#_", searchQuery{tags: []string{"_"}}},
+		{"punctuation only", `!!! ... & | ! ( ) :*`, searchQuery{}},
+		{"punctuation split", "don't", searchQuery{terms: []string{"don <-> t"}}},
+		{"tsquery operators", "a&b|c", searchQuery{terms: []string{"a <-> b <-> c"}}},
+		{"quote in a word", `foo"bar baz"`, searchQuery{terms: []string{"foo <-> bar", "baz"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSearchQuery(tt.q); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.q, got, tt.want)
+			}
+		})
+	}
+}
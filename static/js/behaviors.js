@@ -1,5 +1,5 @@
 import http from './http.js'
-import { likesMsg, followMsg, followersMsg } from './utils.js'
+import { avatarImg, likesMsg, repostsMsg, followMsg, followersMsg } from './utils.js'
 
 /**
  * Connects a like button to the server API.
@@ -21,6 +21,26 @@ export function likeable(button, resource) {
     })
 }
 
+/**
+ * Connects a repost button to the server API.
+ *
+ * @param {HTMLButtonElement} button
+ * @param {string} postId
+ */
+export function repostable(button, postId) {
+    button.addEventListener('click', () => {
+        button.disabled = true
+        http.post(`/api/posts/${postId}/toggle_repost`).then(payload => {
+            button.textContent = String(payload.repostsCount)
+            button.classList[payload.reposted ? 'add' : 'remove']('reposted')
+            button.setAttribute('aria-label', repostsMsg(payload.repostsCount))
+            button.setAttribute('aria-checked', String(payload.reposted))
+        }).catch(console.error).then(() => {
+            button.disabled = false
+        })
+    })
+}
+
 /**
  * Connects a follow button to the server API.
  *
@@ -42,6 +62,70 @@ export function followable(button, username) {
     })
 }
 
+const rxMentionBeforeCaret = /(?:^|\s)@([a-zA-Z][a-zA-Z0-9_-]*)$/
+
+/**
+ * Suggests users to complete the mention being typed.
+ *
+ * @param {HTMLTextAreaElement} textarea
+ */
+export function mentionable(textarea) {
+    const list = document.createElement('ul')
+    list.className = 'autocomplete'
+    list.hidden = true
+    textarea.insertAdjacentElement('afterend', list)
+
+    const mentionPrefix = () => {
+        const match = rxMentionBeforeCaret.exec(textarea.value.slice(0, textarea.selectionStart))
+        return match !== null ? match[1] : null
+    }
+
+    const close = () => {
+        list.hidden = true
+        list.innerHTML = ''
+    }
+
+    const complete = username => {
+        const prefix = mentionPrefix()
+        if (prefix !== null) {
+            const end = textarea.selectionStart
+            textarea.setRangeText(username + ' ', end - prefix.length, end, 'end')
+        }
+        textarea.focus()
+        close()
+    }
+
+    let timeout
+    textarea.addEventListener('input', () => {
+        clearTimeout(timeout)
+        const prefix = mentionPrefix()
+        if (prefix === null) {
+            close()
+            return
+        }
+        timeout = setTimeout(() => {
+            http.get('/api/users/autocomplete?prefix=' + encodeURIComponent(prefix)).then(users => {
+                list.innerHTML = ''
+                for (const user of users) {
+                    const li = document.createElement('li')
+                    const button = document.createElement('button')
+                    button.type = 'button'
+                    button.innerHTML = `${avatarImg(user)}<span>${user.username}</span>`
+                    button.addEventListener('mousedown', ev => {
+                        ev.preventDefault()
+                        complete(user.username)
+                    })
+                    li.appendChild(button)
+                    list.appendChild(li)
+                }
+                list.hidden = users.length === 0
+            }).catch(console.error)
+        }, 200)
+    })
+
+    textarea.addEventListener('blur', close)
+}
+
 export function spoileable(button) {
     const togglerWrapper = button.parentElement
     const articleContent = /** @type {HTMLElement} */ (button.parentElement.parentElement.querySelector('.content'))
@@ -68,22 +68,127 @@ function post(url, payload, headers) {
 }
 
 /**
- * Creates a Server-Sent Event connection
+ * Does a DELETE request.
  *
  * @param {string} url
- * @param {function} callback
  */
-function subscribe(url, callback) {
+const del = url => fetch(url, { method: 'DELETE', credentials: 'include' }).then(handleResponse)
+
+/** @type {Map<string, Set<function>>} */
+const streamListeners = new Map()
+/** @type {Map<string, number>} */
+const streamPostIds = new Map()
+let eventSource = null
+let lastEventId = ''
+
+/**
+ * (Re)opens the shared Server-Sent Event connection
+ * with the post ids currently listened to.
+ * A new EventSource doesn't send Last-Event-ID,
+ * so the last seen id goes in the URL to get what was published in between.
+ */
+function openStream() {
+    if (eventSource !== null) {
+        eventSource.close()
+        eventSource = null
+    }
+    if (streamListeners.size === 0) return
+
+    const q = new URLSearchParams()
+    for (const postId of streamPostIds.keys()) {
+        q.append('post_id', postId)
+    }
+    if (lastEventId !== '') {
+        q.set('last_event_id', lastEventId)
+    }
     // @ts-ignore
-    const eventSource = new EventSource(url)
-    eventSource.onmessage = ev => {
-        try {
-            const payload = JSON.parse(ev.data)
-            callback(payload)
-        } catch (_) { }
+    eventSource = new EventSource('/api/stream?' + q.toString())
+    for (const event of streamListeners.keys()) {
+        eventSource.addEventListener(event, dispatchStreamEvent)
+    }
+}
+
+function dispatchStreamEvent(ev) {
+    if (ev.lastEventId !== '') {
+        lastEventId = ev.lastEventId
+    }
+    const listeners = streamListeners.get(ev.type)
+    if (listeners === undefined) return
+    let payload
+    try {
+        payload = JSON.parse(ev.data)
+    } catch (_) {
+        return
+    }
+    for (const callback of listeners) {
+        callback(payload)
+    }
+}
+
+let reopenScheduled = false
+
+/**
+ * Reopens the stream once all the (un)subscriptions
+ * of the current task are done.
+ */
+function reopenStream() {
+    if (reopenScheduled) return
+    reopenScheduled = true
+    queueMicrotask(() => {
+        reopenScheduled = false
+        openStream()
+    })
+}
+
+/**
+ * Listens to an event of the shared Server-Sent Event connection.
+ * Pass postIds to also stream those posts events.
+ *
+ * @param {string} event
+ * @param {function} callback
+ * @param {(string|string[])=} postIds
+ */
+function subscribe(event, callback, postIds = []) {
+    const ids = typeof postIds === 'string' ? [postIds] : postIds
+    let reopen = eventSource === null
+    if (!streamListeners.has(event)) {
+        streamListeners.set(event, new Set())
+        if (eventSource !== null) {
+            eventSource.addEventListener(event, dispatchStreamEvent)
+        }
+    }
+    streamListeners.get(event).add(callback)
+    for (const postId of ids) {
+        const count = streamPostIds.get(postId) || 0
+        streamPostIds.set(postId, count + 1)
+        reopen = reopen || count === 0
     }
+    if (reopen) {
+        reopenStream()
+    }
+
     return () => {
-        eventSource.close()
+        const listeners = streamListeners.get(event)
+        listeners.delete(callback)
+        if (listeners.size === 0) {
+            streamListeners.delete(event)
+            if (eventSource !== null) {
+                eventSource.removeEventListener(event, dispatchStreamEvent)
+            }
+        }
+        let reopen = streamListeners.size === 0
+        for (const postId of ids) {
+            const count = streamPostIds.get(postId) - 1
+            if (count === 0) {
+                streamPostIds.delete(postId)
+                reopen = true
+                continue
+            }
+            streamPostIds.set(postId, count)
+        }
+        if (reopen) {
+            reopenStream()
+        }
     }
 }
 
@@ -91,5 +196,6 @@ export default {
     handleResponse,
     get,
     post,
+    del,
     subscribe,
 }
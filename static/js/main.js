@@ -52,6 +52,7 @@ const route = router([
     [/^\/users\/([^\/]+)\/followers$/, genPage('followers')],
     [/^\/users\/([^\/]+)$/, genPage('user')],
     [/^\/posts\/([^\/]+)$/, genPage('post')],
+    [/^\/tags\/([^\/]+)$/, genPage('tag')],
     [/^\//, notFound],
 ])
 
@@ -29,7 +29,7 @@ if (authenticated && location.pathname !== '/notifications') {
 }
 
 if (authenticated) {
-    http.subscribe('/api/notifications', notification => {
+    http.subscribe('notification', notification => {
         const { pathname } = location
         if (pathname === '/notifications') {
             dispatchEvent(new CustomEvent('notification', { detail: notification }))
@@ -1,6 +1,6 @@
-import { likeable, spoileable } from '../behaviors.js'
+import { likeable, mentionable, repostable, spoileable } from '../behaviors.js'
 import http from '../http.js'
-import { ago, avatarImg, commentsMsg, escapeHTML, likesMsg, linkify, sanitizeContent, wrapInSpoiler } from '../utils.js'
+import { ago, avatarImg, commentsMsg, escapeHTML, likesMsg, linkify, mediaHTML, repostsMsg, sanitizeContent, wrapInSpoiler } from '../utils.js'
 
 const template = document.createElement('template')
 template.innerHTML = `
@@ -12,6 +12,8 @@ template.innerHTML = `
             <input type="checkbox"> Spoiler
         </label>
         <input type="text" placeholder="Spoiler of..." maxlength="128" hidden>
+        <input type="file" accept="image/jpeg,image/png,image/gif" multiple>
+        <div id="post-media"></div>
         <button type="submit">Post</button>
     </form>
     <button id="flush-queue" hidden></button>
@@ -20,39 +22,48 @@ template.innerHTML = `
 </div>
 `
 
-let lastFeedItemId
+// Same as streamMaxPosts in stream.go.
+const maxStreamedPosts = 50
+
+let lastFeedItemCursor
+let feedHasMore = false
 const feedQueue = []
 const feedCache = []
 
-function addToCache(feed) {
-    feedCache.push(...feed)
-    return feed
+function addToCache(page) {
+    feedCache.push(...page.items)
+    feedHasMore = page.hasMore
+    return page.items
 }
 
-function saveLastItemId(feed) {
+function saveLastItemCursor(feed) {
     const l = feed.length
     if (l !== 0) {
-        lastFeedItemId = feed[l - 1]['id']
+        lastFeedItemCursor = feed[l - 1]['cursor']
     }
     return feed
 }
 
 const getFeed = () => feedCache.length !== 0
     ? Promise.resolve(feedCache)
-    : http.get('/api/feed').then(addToCache).then(saveLastItemId)
+    : http.get('/api/feed').then(addToCache).then(saveLastItemCursor)
 
-const loadMore = () => typeof lastFeedItemId === 'undefined'
+const loadMore = () => typeof lastFeedItemCursor === 'undefined'
     ? Promise.resolve([])
-    : http.get('/api/feed?before=' + lastFeedItemId).then(addToCache).then(saveLastItemId)
+    : http.get('/api/feed?before=' + encodeURIComponent(lastFeedItemCursor)).then(addToCache).then(saveLastItemCursor)
 
 function createFeedItemArticle(feedItem) {
-    const { post } = feedItem
+    const { post, repostedBy } = feedItem
     const { user } = post
     const createdAt = ago(post.createdAt)
     const content = linkify(escapeHTML(post.content))
 
     const article = document.createElement('article')
+    article.dataset.postId = post.id
     article.innerHTML = wrapInSpoiler(post.spoilerOf, `
+        ${typeof repostedBy === 'object' ? `
+            <a href="/users/${repostedBy.username}" class="reposted-by">${repostedBy.username} reposted</a>
+        ` : ''}
         <header>
             <a href="/users/${user.username}">
                 ${avatarImg(user)}
@@ -61,9 +72,14 @@ function createFeedItemArticle(feedItem) {
             <a href="/posts/${post.id}" class="created-at"><time>${createdAt}</time></a>
         </header>
         <p style="white-space: pre">${content}</p>
+        ${mediaHTML(post.media)}
+        ${post.quoteOfId !== null ? `
+            <a href="/posts/${post.quoteOfId}" class="quote-of">Quoted post</a>
+        ` : ''}
         <div>
             <button role="switch" class="likes-count${post.liked ? ' liked' : ''}" aria-label="${likesMsg(post.likesCount)}" aria-checked="${post.liked}">${post.likesCount}</button>
             <a class="comments-count" href="/posts/${post.id}" title="${commentsMsg(post.commentsCount)}">${post.commentsCount}</a>
+            <button role="switch" class="reposts-count${post.reposted ? ' reposted' : ''}" aria-label="${repostsMsg(post.repostsCount)}" aria-checked="${post.reposted}">${post.repostsCount}</button>
         </div>
     `)
 
@@ -72,6 +88,7 @@ function createFeedItemArticle(feedItem) {
     }
 
     likeable(article.querySelector('.likes-count'), `posts/${post.id}`)
+    repostable(article.querySelector('.reposts-count'), post.id)
 
     return article
 }
@@ -82,6 +99,8 @@ export default function () {
     const postTextArea = postForm.querySelector('textarea')
     const postSpoilerCheckbox = /** @type {HTMLInputElement} */ (postForm.querySelector('input[type=checkbox]'))
     const postSpoilerInput = /** @type {HTMLInputElement} */ (postForm.querySelector('input[type=text]'))
+    const postMediaInput = /** @type {HTMLInputElement} */ (postForm.querySelector('input[type=file]'))
+    const postMediaDiv = postForm.querySelector('#post-media')
     const postButton = postForm.querySelector('button')
     const flushQueueButton = page.getElementById('flush-queue')
     const feedDiv = page.getElementById('feed')
@@ -106,6 +125,13 @@ export default function () {
         if (isSpoiler) {
             payload['spoilerOf'] = spoilerOf
         }
+        const media = Array.from(postMediaDiv.querySelectorAll('figure')).map(figure => ({
+            id: figure.dataset.mediaId,
+            altText: figure.querySelector('input').value,
+        }))
+        if (media.length !== 0) {
+            payload['media'] = media
+        }
 
         postTextArea.disabled = true
         postButton.disabled = true
@@ -113,12 +139,14 @@ export default function () {
         http.post('/api/posts', payload).then(feedItem => {
             flushQueue()
             feedDiv.insertBefore(createFeedItemArticle(feedItem), feedDiv.firstChild)
+            streamCounters([feedItem])
             postForm.reset()
             postTextArea.setCustomValidity('')
             postSpoilerInput.setCustomValidity('')
             postSpoilerCheckbox.checked = false
             postSpoilerInput.hidden = true
             postSpoilerInput.required = false
+            postMediaDiv.innerHTML = ''
         }).catch(err => {
             console.error(err)
             alert(err.message)
@@ -133,6 +161,8 @@ export default function () {
         postTextArea.setCustomValidity('')
     })
 
+    mentionable(postTextArea)
+
     postSpoilerCheckbox.addEventListener('change', () => {
         if (postSpoilerCheckbox.checked) {
             postSpoilerInput.hidden = false
@@ -147,11 +177,74 @@ export default function () {
         postSpoilerInput.setCustomValidity('')
     })
 
+    postMediaInput.addEventListener('change', () => {
+        const files = Array.from(postMediaInput.files)
+        postMediaInput.value = ''
+        if (postMediaDiv.children.length + files.length > 4) {
+            alert('Up to 4 images')
+            return
+        }
+        postMediaInput.disabled = true
+        postButton.disabled = true
+        Promise.all(files.map(file => http.post('/api/media', file, { 'Content-Type': file.type }).then(media => {
+            const figure = document.createElement('figure')
+            figure.dataset.mediaId = media.id
+            figure.innerHTML = `
+                <img src="${media.url}" width="${media.width}" height="${media.height}" alt="">
+                <input type="text" placeholder="Description" maxlength="420">
+                <button type="button">Remove</button>
+            `
+            figure.querySelector('button').addEventListener('click', () => {
+                figure.remove()
+            })
+            postMediaDiv.appendChild(figure)
+        }))).catch(err => {
+            console.error(err)
+            alert(err.message)
+        }).then(() => {
+            postMediaInput.disabled = false
+            postButton.disabled = false
+        })
+    })
+
+    const updateCounters = counters => {
+        if (typeof counters.commentId === 'string') return
+        for (const article of feedDiv.querySelectorAll(`article[data-post-id="${counters.postId}"]`)) {
+            const likesCountEl = article.querySelector('.likes-count')
+            likesCountEl.textContent = String(counters.likesCount)
+            likesCountEl.setAttribute('aria-label', likesMsg(counters.likesCount))
+            const commentsCountEl = article.querySelector('.comments-count')
+            commentsCountEl.textContent = String(counters.commentsCount)
+            commentsCountEl.setAttribute('title', commentsMsg(counters.commentsCount))
+            const repostsCountEl = article.querySelector('.reposts-count')
+            repostsCountEl.textContent = String(counters.repostsCount)
+            repostsCountEl.setAttribute('aria-label', repostsMsg(counters.repostsCount))
+        }
+    }
+
+    let streamedPostIds = []
+    let unsubscribeFromCounters = () => {}
+    /**
+     * Streams the counters of the posts just shown,
+     * along with the latest shown ones up to maxStreamedPosts.
+     */
+    const streamCounters = feedItems => {
+        const postIds = feedItems.map(feedItem => feedItem.post.id)
+        streamedPostIds = [...new Set([...streamedPostIds.filter(id => !postIds.includes(id)), ...postIds])]
+            .slice(-maxStreamedPosts)
+        const unsubscribePrevious = unsubscribeFromCounters
+        unsubscribeFromCounters = http.subscribe('counters', counters => updateCounters(counters), streamedPostIds)
+        unsubscribePrevious()
+    }
+
     const flushQueue = () => {
-        let feedItem
-        while (feedItem = feedQueue.shift()) {
+        const flushed = feedQueue.splice(0, feedQueue.length)
+        for (const feedItem of flushed) {
             feedDiv.insertBefore(createFeedItemArticle(feedItem), feedDiv.firstChild)
         }
+        if (flushed.length !== 0) {
+            streamCounters(flushed)
+        }
         flushQueueButton.hidden = true
     }
 
@@ -161,7 +254,8 @@ export default function () {
         feed.forEach(feedItem => {
             feedDiv.appendChild(createFeedItemArticle(feedItem))
         })
-        if (feed.length == 25) {
+        streamCounters(feed)
+        if (feedHasMore) {
             loadMoreButton.hidden = false
         }
     }).catch(console.error)
@@ -173,11 +267,12 @@ export default function () {
                 feed.forEach(feedItem => {
                     feedDiv.appendChild(createFeedItemArticle(feedItem))
                 })
+                streamCounters(feed)
                 return feed
             })
             .catch(console.error)
-            .then(feed => {
-                if (feed.length < 25) {
+            .then(() => {
+                if (!feedHasMore) {
                     loadMoreButton.hidden = true
                     return
                 }
@@ -185,7 +280,9 @@ export default function () {
             })
     })
 
-    const unsubscribe = http.subscribe('/api/feed', feedItem => {
+    const unsubscribe = http.subscribe('feed', feedItem => {
+        // Replayed after the stream reopened; already shown.
+        if (feedCache.some(item => item.id === feedItem.id)) return
         feedQueue.push(feedItem)
         feedCache.unshift(feedItem)
         flushQueueButton.hidden = false
@@ -193,7 +290,27 @@ export default function () {
         flushQueueButton.textContent = `${l} new post${l !== 1 ? 's' : ''}`
     })
 
-    page.addEventListener('disconnect', unsubscribe)
+    const unsubscribeFromDeletions = http.subscribe('post_deleted', ({ postId }) => {
+        for (const list of [feedQueue, feedCache]) {
+            const i = list.findIndex(feedItem => feedItem.post.id === postId)
+            if (i !== -1) {
+                list.splice(i, 1)
+            }
+        }
+        const article = feedDiv.querySelector(`article[data-post-id="${postId}"]`)
+        if (article !== null) {
+            article.remove()
+        }
+        const l = feedQueue.length
+        flushQueueButton.hidden = l === 0
+        flushQueueButton.textContent = `${l} new post${l !== 1 ? 's' : ''}`
+    })
+
+    page.addEventListener('disconnect', () => {
+        unsubscribe()
+        unsubscribeFromDeletions()
+        unsubscribeFromCounters()
+    })
 
     return page
 }
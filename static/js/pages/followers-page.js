@@ -6,6 +6,7 @@ template.innerHTML = `
 <div class="container">
     <h1>Followers</h1>
     <div id="results" class="articles"></div>
+    <button id="load-more" hidden>Load more</button>
 </div>
 `
 
@@ -13,11 +14,29 @@ export default function (username) {
     const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
     const title = page.querySelector('h1')
     const resultsDiv = page.getElementById('results')
+    const loadMoreButton = /** @type {HTMLButtonElement} */ (page.getElementById('load-more'))
+    let lastUsername
 
     title.textContent = `${username}'s followers`
 
-    http.get(`/api/users/${username}/followers`).then(users => {
+    const addUsers = ({ items: users, hasMore }) => {
         usersList(resultsDiv, users)
+        if (users.length !== 0) {
+            lastUsername = users[users.length - 1].username
+        }
+        loadMoreButton.hidden = !hasMore
+    }
+
+    http.get(`/api/users/${username}/followers`).then(addUsers).catch(console.error)
+
+    loadMoreButton.addEventListener('click', () => {
+        loadMoreButton.disabled = true
+        http.get(`/api/users/${username}/followers?after=${encodeURIComponent(lastUsername)}`)
+            .then(addUsers)
+            .catch(console.error)
+            .then(() => {
+                loadMoreButton.disabled = false
+            })
     })
 
     return page
@@ -1,7 +1,7 @@
 import { getAuthUser } from '../auth.js'
-import { likeable } from '../behaviors.js'
+import { likeable, mentionable, repostable } from '../behaviors.js'
 import http from '../http.js'
-import { ago, avatarImg, commentsMsg, escapeHTML, goto, likesMsg, linkify, sanitizeContent } from '../utils.js'
+import { ago, avatarImg, commentsMsg, escapeHTML, goto, likesMsg, linkify, mediaHTML, quotesMsg, repostsMsg, sanitizeContent } from '../utils.js'
 
 const authenticated = getAuthUser() !== null
 
@@ -9,6 +9,7 @@ const template = document.createElement('template')
 template.innerHTML = `
 <div class="post-wrapper"></div>
 <div class="container">
+    <button id="older-comments" hidden>Load older comments</button>
     <div id="comments" class="articles" role="feed"></div>
     <button id="flush-queue" hidden></button>
     <form id="comment-form" hidden>
@@ -18,8 +19,43 @@ template.innerHTML = `
 </div>
 `
 
-function createCommentArticle(comment) {
+/**
+ * @param {object} post
+ */
+function quotedPostHTML(post) {
+    if (post.quoteOfId === null) return ''
+    const { quoteOf } = post
+    if (typeof quoteOf !== 'object') {
+        return `<p class="quote-of">Quoted post unavailable</p>`
+    }
+    return `
+        <a href="/posts/${quoteOf.id}" class="quote-of">
+            <strong>${quoteOf.user.username}</strong>
+            <span>${escapeHTML(quoteOf.spoilerOf !== null ? 'Spoiler of ' + quoteOf.spoilerOf : quoteOf.content)}</span>
+        </a>
+    `
+}
+
+const repliesMsg = n => `${n} ${n === 1 ? 'reply' : 'replies'}`
+
+/**
+ * @param {HTMLElement} article
+ * @param {number} repliesCount
+ */
+function setRepliesCount(article, repliesCount) {
+    const repliesCountButton = article.querySelector('.replies-count')
+    article.dataset.repliesCount = String(repliesCount)
+    repliesCountButton.textContent = repliesMsg(repliesCount)
+    repliesCountButton.hidden = repliesCount === 0 || article.dataset.repliesLoaded === 'true'
+}
+
+/**
+ * @param {any} comment
+ * @param {function=} onReply called with the comment when replying to it.
+ */
+function createCommentArticle(comment, onReply) {
     const { user } = comment
+    const isReply = comment.parentCommentId !== null
     const createdAt = ago(comment.createdAt)
     const content = linkify(escapeHTML(comment.content))
 
@@ -32,18 +68,89 @@ function createCommentArticle(comment) {
                 ${avatarImg(user)}
                 <span>${user.username}</span>
             </a>
-            <time class="created-at">${createdAt}</time>
+            <time class="created-at">${createdAt}${comment.editedAt !== null ? ' (edited)' : ''}</time>
         </header>
         <p>${content}</p>
         <div>
             <${authenticated ? 'button role="switch"' : 'span'} class="likes-count${comment.liked ? ' liked' : ''}" aria-label="${likesMsg(comment.likesCount)}"${authenticated ? ` aria-checked="${comment.liked}"` : ''}>${comment.likesCount}</${authenticated ? 'button' : 'span'}>
+            ${isReply ? '' : `<button class="replies-count" hidden></button>`}
+            ${!isReply && authenticated ? '<button class="reply">Reply</button>' : ''}
+            ${comment.mine ? '<button class="delete-comment">Delete</button>' : ''}
         </div>
+        ${isReply ? '' : '<div class="replies"><button class="older-replies" hidden>Load older replies</button></div>'}
     `
 
     if (authenticated) {
         likeable(article.querySelector('.likes-count'), `comments/${comment.id}`)
     }
 
+    if (!isReply) {
+        setRepliesCount(article, comment.repliesCount)
+
+        const repliesCountButton = /** @type {HTMLButtonElement} */ (article.querySelector('.replies-count'))
+        const olderRepliesButton = /** @type {HTMLButtonElement} */ (article.querySelector('.older-replies'))
+
+        // Replies come newest first and are shown oldest first, under the older replies button.
+        // The replies div moves to the new article when the comment is edited,
+        // so it's looked up on each load and the cursor is kept in it.
+        const addReplies = repliesDiv => ({ items: replies, hasMore }) => {
+            const button = /** @type {HTMLButtonElement} */ (repliesDiv.querySelector('.older-replies'))
+            replies.forEach(reply => {
+                repliesDiv.insertBefore(createCommentArticle(reply), button.nextSibling)
+            })
+            if (replies.length !== 0) {
+                button.dataset.cursor = replies[replies.length - 1].cursor
+            }
+            button.hidden = !hasMore
+        }
+
+        repliesCountButton.addEventListener('click', () => {
+            repliesCountButton.disabled = true
+            http.get(`/api/comments/${comment.id}/replies`).then(replies => {
+                addReplies(article.querySelector('.replies'))(replies)
+                article.dataset.repliesLoaded = 'true'
+                repliesCountButton.hidden = true
+            }).catch(console.error).then(() => {
+                repliesCountButton.disabled = false
+            })
+        })
+
+        olderRepliesButton.addEventListener('click', () => {
+            olderRepliesButton.disabled = true
+            http.get(`/api/comments/${comment.id}/replies?before=${encodeURIComponent(olderRepliesButton.dataset.cursor)}`)
+                .then(addReplies(olderRepliesButton.parentElement))
+                .catch(console.error)
+                .then(() => {
+                    olderRepliesButton.disabled = false
+                })
+        })
+
+        if (authenticated && typeof onReply === 'function') {
+            article.querySelector('.reply').addEventListener('click', () => {
+                onReply(comment)
+            })
+        }
+    }
+
+    if (comment.mine) {
+        const deleteButton = /** @type {HTMLButtonElement} */ (article.querySelector('.delete-comment'))
+        deleteButton.addEventListener('click', () => {
+            if (!confirm('Delete this comment?')) return
+            deleteButton.disabled = true
+            http.del('/api/comments/' + comment.id).then(() => {
+                const parentEl = isReply ? article.parentElement.closest('.comment') : null
+                article.remove()
+                if (parentEl instanceof HTMLElement) {
+                    setRepliesCount(parentEl, parseInt(parentEl.dataset.repliesCount, 10) - 1)
+                }
+            }).catch(err => {
+                console.error(err)
+                alert(err.message)
+                deleteButton.disabled = false
+            })
+        })
+    }
+
     return article
 }
 
@@ -54,23 +161,66 @@ export default function (postId) {
     const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
     const postDiv = page.querySelector('.post-wrapper')
     const commentsDiv = page.getElementById('comments')
+    const olderCommentsButton = /** @type {HTMLButtonElement} */ (page.getElementById('older-comments'))
     const flushQueueButton = page.getElementById('flush-queue')
     const commentForm = /** @type {HTMLFormElement} */ (page.getElementById('comment-form'))
     const commentTextArea = commentForm.querySelector('textarea')
     const commentButton = commentForm.querySelector('button')
     let commentsCountSpan = /** @type {HTMLSpanElement} */ (null)
     let subscribeButton = /** @type {HTMLButtonElement} */ (null)
+    let replyTo = null
+    let oldestCursor
+
+    const onReply = comment => {
+        replyTo = comment
+        commentTextArea.placeholder = `Reply to ${comment.user.username}...`
+        commentTextArea.focus()
+    }
+
+    // Comments come newest first and are shown oldest first.
+    const addOlderComments = ({ items: comments, hasMore }) => {
+        comments.forEach(comment => {
+            commentsDiv.insertBefore(createCommentArticle(comment, onReply), commentsDiv.firstChild)
+        })
+        if (comments.length !== 0) {
+            oldestCursor = comments[comments.length - 1].cursor
+        }
+        olderCommentsButton.hidden = !hasMore
+    }
 
     const flushQueue = () => {
         let comment
         while (comment = commentsQueue.shift()) {
-            commentsDiv.appendChild(createCommentArticle(comment))
+            commentsDiv.appendChild(createCommentArticle(comment, onReply))
         }
         flushQueueButton.hidden = true
     }
 
+    /**
+     * Places a reply under its comment if its replies are shown,
+     * otherwise just counts it.
+     */
+    const addReply = reply => {
+        const parentEl = /** @type {HTMLElement} */ (commentsDiv.querySelector('#comment-' + reply.parentCommentId))
+        if (parentEl === null) return
+        if (parentEl.dataset.repliesLoaded === 'true') {
+            parentEl.querySelector('.replies').appendChild(createCommentArticle(reply))
+        }
+        setRepliesCount(parentEl, parseInt(parentEl.dataset.repliesCount, 10) + 1)
+    }
+
     flushQueueButton.addEventListener('click', flushQueue)
 
+    olderCommentsButton.addEventListener('click', () => {
+        olderCommentsButton.disabled = true
+        http.get(`/api/posts/${postId}/comments?before=${encodeURIComponent(oldestCursor)}`)
+            .then(addOlderComments)
+            .catch(console.error)
+            .then(() => {
+                olderCommentsButton.disabled = false
+            })
+    })
+
     const incrementCommentsCount = () => {
         if (commentsCountSpan !== null) {
             const oldCount = parseInt(commentsCountSpan.textContent, 10)
@@ -93,16 +243,30 @@ export default function (postId) {
                         ${avatarImg(user)}
                         <span>${user.username}</span>
                     </a>
-                    <time class="created-at">${createdAt}</time>
+                    <time class="created-at">${createdAt}${post.editedAt !== null ? ' (edited)' : ''}</time>
                 </header>
                 <p>${content}</p>
+                ${mediaHTML(post.media)}
+                ${quotedPostHTML(post)}
                 <div>
                     <${authenticated ? 'button role="switch"' : 'span'} class="likes-count${post.liked ? ' liked' : ''}" aria-label="${likesMsg(post.likesCount)}"${authenticated ? ` aria-checked="${post.liked}"` : ''}>${post.likesCount}</${authenticated ? 'button' : 'span'}>
                     <span class="comments-count" title="${commentsMsg(post.commentsCount)}">${post.commentsCount}</span>
+                    <${authenticated ? 'button role="switch"' : 'span'} class="reposts-count${post.reposted ? ' reposted' : ''}" aria-label="${repostsMsg(post.repostsCount)}"${authenticated ? ` aria-checked="${post.reposted}"` : ''}>${post.repostsCount}</${authenticated ? 'button' : 'span'}>
+                    <span class="quotes-count" title="${quotesMsg(post.quotesCount)}">${post.quotesCount}</span>
                     ${authenticated ? `
                         <button id="subscribe">${subscribeMsg(post.subscribed)}</button>
+                        <button id="quote">Quote</button>
+                    ` : ''}
+                    ${post.mine ? `
+                        <button id="delete-post">Delete</button>
                     ` : ''}
                 </div>
+                ${authenticated ? `
+                    <form id="quote-form" hidden>
+                        <textarea placeholder="Add a comment..." maxlength="480" required></textarea>
+                        <button type="submit">Quote</button>
+                    </form>
+                ` : ''}
             </article>
         `
 
@@ -110,6 +274,42 @@ export default function (postId) {
 
         if (authenticated) {
             likeable(postDiv.querySelector('.likes-count'), `posts/${post.id}`)
+            repostable(postDiv.querySelector('.reposts-count'), post.id)
+
+            const quoteForm = /** @type {HTMLFormElement} */ (postDiv.querySelector('#quote-form'))
+            const quoteTextArea = quoteForm.querySelector('textarea')
+            const quoteButton = quoteForm.querySelector('button')
+            postDiv.querySelector('#quote').addEventListener('click', () => {
+                quoteForm.hidden = !quoteForm.hidden
+                if (!quoteForm.hidden) {
+                    quoteTextArea.focus()
+                }
+            })
+            quoteForm.addEventListener('submit', ev => {
+                ev.preventDefault()
+                const content = sanitizeContent(quoteTextArea.value)
+                if (content === '') {
+                    quoteTextArea.setCustomValidity('Empty')
+                    return
+                }
+
+                quoteTextArea.disabled = true
+                quoteButton.disabled = true
+
+                http.post('/api/posts', { content, quoteOfId: post.id }).then(feedItem => {
+                    goto('/posts/' + feedItem.post.id)
+                }).catch(err => {
+                    console.error(err)
+                    alert(err.message)
+                    quoteTextArea.disabled = false
+                    quoteButton.disabled = false
+                    quoteTextArea.focus()
+                })
+            })
+            quoteTextArea.addEventListener('input', () => {
+                quoteTextArea.setCustomValidity('')
+            })
+            mentionable(quoteTextArea)
 
             subscribeButton = postDiv.querySelector('#subscribe')
             subscribeButton.addEventListener('click', () => {
@@ -122,9 +322,22 @@ export default function (postId) {
             })
         }
 
-        comments.forEach(comment => {
-            commentsDiv.insertBefore(createCommentArticle(comment), commentsDiv.firstChild)
-        })
+        if (post.mine) {
+            const deleteButton = /** @type {HTMLButtonElement} */ (postDiv.querySelector('#delete-post'))
+            deleteButton.addEventListener('click', () => {
+                if (!confirm('Delete this post?')) return
+                deleteButton.disabled = true
+                http.del('/api/posts/' + post.id).then(() => {
+                    goto('/', true)
+                }).catch(err => {
+                    console.error(err)
+                    alert(err.message)
+                    deleteButton.disabled = false
+                })
+            })
+        }
+
+        addOlderComments(comments)
 
         const commentId = location.hash
         if (commentId.startsWith('#comment-')) {
@@ -154,9 +367,20 @@ export default function (postId) {
             commentTextArea.disabled = true
             commentButton.disabled = true
 
-            http.post(`/api/posts/${postId}/comments`, { content }).then(comment => {
-                flushQueue()
-                commentsDiv.appendChild(createCommentArticle(comment))
+            const payload = { content }
+            if (replyTo !== null) {
+                payload['parentCommentId'] = replyTo.id
+            }
+
+            http.post(`/api/posts/${postId}/comments`, payload).then(comment => {
+                if (comment.parentCommentId !== null) {
+                    addReply(comment)
+                } else {
+                    flushQueue()
+                    commentsDiv.appendChild(createCommentArticle(comment, onReply))
+                }
+                replyTo = null
+                commentTextArea.placeholder = 'Comment something...'
                 commentForm.reset()
                 commentTextArea.setCustomValidity('')
                 incrementCommentsCount()
@@ -176,17 +400,108 @@ export default function (postId) {
         commentTextArea.addEventListener('input', () => {
             commentTextArea.setCustomValidity('')
         })
+
+        mentionable(commentTextArea)
     }
 
-    const unsubscribe = http.subscribe(`/api/posts/${postId}/comments`, comment => {
+    const unsubscribe = http.subscribe('comment', comment => {
+        if (comment.postId !== postId) return
+        // Replayed after the stream reopened; already shown.
+        if (commentsDiv.querySelector('#comment-' + comment.id) !== null || commentsQueue.some(c => c.id === comment.id)) return
+        if (comment.parentCommentId !== null) {
+            addReply(comment)
+            return
+        }
         commentsQueue.push(comment)
         const l = commentsQueue.length
         flushQueueButton.textContent = `${l} new comment${l !== 1 ? 's' : ''}`
         flushQueueButton.hidden = false
-        incrementCommentsCount()
-    })
+    }, postId)
 
-    page.addEventListener('disconnect', unsubscribe)
+    const unsubscribeFromCounters = http.subscribe('counters', counters => {
+        if (counters.postId !== postId) return
+        if (typeof counters.commentId === 'string') {
+            const likesCountEl = commentsDiv.querySelector(`#comment-${counters.commentId} .likes-count`)
+            if (likesCountEl !== null) {
+                likesCountEl.textContent = String(counters.likesCount)
+                likesCountEl.setAttribute('aria-label', likesMsg(counters.likesCount))
+            }
+            return
+        }
+        const likesCountEl = postDiv.querySelector('.likes-count')
+        if (likesCountEl !== null) {
+            likesCountEl.textContent = String(counters.likesCount)
+            likesCountEl.setAttribute('aria-label', likesMsg(counters.likesCount))
+        }
+        if (commentsCountSpan !== null) {
+            commentsCountSpan.textContent = String(counters.commentsCount)
+            commentsCountSpan.title = commentsMsg(counters.commentsCount)
+        }
+        const repostsCountEl = postDiv.querySelector('.reposts-count')
+        if (repostsCountEl !== null) {
+            repostsCountEl.textContent = String(counters.repostsCount)
+            repostsCountEl.setAttribute('aria-label', repostsMsg(counters.repostsCount))
+        }
+        const quotesCountEl = postDiv.querySelector('.quotes-count')
+        if (quotesCountEl !== null) {
+            quotesCountEl.textContent = String(counters.quotesCount)
+            quotesCountEl.setAttribute('title', quotesMsg(counters.quotesCount))
+        }
+    }, postId)
+
+    const unsubscribeFromCommentUpdates = http.subscribe('comment_updated', comment => {
+        if (comment.postId !== postId) return
+        const queued = commentsQueue.findIndex(c => c.id === comment.id)
+        if (queued !== -1) {
+            commentsQueue[queued] = comment
+            return
+        }
+        const commentEl = /** @type {HTMLElement} */ (commentsDiv.querySelector('#comment-' + comment.id))
+        if (commentEl !== null) {
+            const article = createCommentArticle(comment, onReply)
+            const repliesDiv = commentEl.querySelector('.replies')
+            if (repliesDiv !== null) {
+                article.dataset.repliesLoaded = commentEl.dataset.repliesLoaded
+                article.querySelector('.replies').replaceWith(repliesDiv)
+                setRepliesCount(article, parseInt(commentEl.dataset.repliesCount, 10))
+            }
+            commentEl.replaceWith(article)
+        }
+    }, postId)
+
+    const unsubscribeFromCommentDeletions = http.subscribe('comment_deleted', deletion => {
+        if (deletion.postId !== postId) return
+        const queued = commentsQueue.findIndex(c => c.id === deletion.commentId)
+        if (queued !== -1) {
+            commentsQueue.splice(queued, 1)
+            const l = commentsQueue.length
+            flushQueueButton.textContent = `${l} new comment${l !== 1 ? 's' : ''}`
+            flushQueueButton.hidden = l === 0
+        }
+        const commentEl = commentsDiv.querySelector('#comment-' + deletion.commentId)
+        if (commentEl !== null) {
+            commentEl.remove()
+        }
+        if (deletion.parentCommentId !== null) {
+            const parentEl = /** @type {HTMLElement} */ (commentsDiv.querySelector('#comment-' + deletion.parentCommentId))
+            if (parentEl !== null) {
+                setRepliesCount(parentEl, parseInt(parentEl.dataset.repliesCount, 10) - 1)
+            }
+        }
+    }, postId)
+
+    const unsubscribeFromDeletion = http.subscribe('post_deleted', deletion => {
+        if (deletion.postId !== postId) return
+        goto('/not-found', true)
+    }, postId)
+
+    page.addEventListener('disconnect', () => {
+        unsubscribe()
+        unsubscribeFromCounters()
+        unsubscribeFromCommentUpdates()
+        unsubscribeFromCommentDeletions()
+        unsubscribeFromDeletion()
+    })
 
     return page
 }
@@ -1,43 +1,117 @@
-import { getAuthUser } from '../auth.js'
+import { spoileable } from '../behaviors.js'
 import http from '../http.js'
-import { goto } from '../utils.js'
+import { ago, avatarImg, escapeHTML, goto, linkify, wrapInSpoiler } from '../utils.js'
 import usersList from '../users-list.js'
 
-const authenticated = getAuthUser() !== null
-
 const template = document.createElement('template')
 template.innerHTML = `
 <div class="container">
     <h1>Search</h1>
     <form id="search">
         <input type="search" placeholder="Search..." autofocus required>
+        <select>
+            <option value="content">Posts and comments</option>
+            <option value="users">Users</option>
+        </select>
         <button type="submit">Search</button>
     </form>
+    <p class="search-help">Use "quotes" for phrases, from:username and #tag.</p>
     <div id="results" class="articles"></div>
+    <button id="load-more" hidden>Load more</button>
+    <h2>Trending</h2>
+    <ol id="trending-tags"></ol>
 </div>
 `
 
+function createSearchResultArticle(result) {
+    const item = result.post || result.comment
+    const { user } = item
+    const postId = typeof result.post === 'object' ? result.post.id : result.comment.postId
+    const href = typeof result.post === 'object' ? `/posts/${postId}` : `/posts/${postId}#comment-${item.id}`
+    const content = linkify(escapeHTML(item.content))
+
+    const article = document.createElement('article')
+    article.innerHTML = wrapInSpoiler(typeof item.spoilerOf === 'string' ? item.spoilerOf : null, `
+        <header>
+            <a href="/users/${user.username}">
+                ${avatarImg(user)}
+                <span>${user.username}</span>
+            </a>
+            <a href="${href}" class="created-at"><time>${ago(item.createdAt)}</time></a>
+        </header>
+        <p>${typeof result.comment === 'object' ? '💬 ' : ''}${content}</p>
+    `)
+
+    if (typeof item.spoilerOf === 'string') {
+        spoileable(article.querySelector('.spoiler-toggler'))
+    }
+
+    return article
+}
+
 export default function () {
     const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
     const searchForm = /** @type {HTMLFormElement} */ (page.getElementById('search'))
     const searchInput = searchForm.querySelector('input')
+    const searchSelect = searchForm.querySelector('select')
     const searchButton = searchForm.querySelector('button')
     const resultDiv = page.getElementById('results')
+    const loadMoreButton = /** @type {HTMLButtonElement} */ (page.getElementById('load-more'))
+    const trendingTagsList = page.getElementById('trending-tags')
+    let lastQuery = ''
+    let lastSearch = ''
+    let lastCursor
 
     searchInput.focus()
 
+    http.get('/api/tags/trending').then(tags => {
+        for (const { tag, postsCount } of tags) {
+            const li = document.createElement('li')
+            li.innerHTML = `<a href="/tags/${encodeURIComponent(tag)}">#${tag}</a> <span>${postsCount} post${postsCount !== 1 ? 's' : ''}</span>`
+            trendingTagsList.appendChild(li)
+        }
+    }).catch(console.error)
+
+    const addResults = ({ items: results, hasMore }) => {
+        results.forEach(result => {
+            resultDiv.appendChild(createSearchResultArticle(result))
+        })
+        if (results.length !== 0) {
+            lastCursor = results[results.length - 1].cursor
+        }
+        loadMoreButton.hidden = !hasMore
+    }
+
+    const addUsers = ({ items: users, hasMore }) => {
+        usersList(resultDiv, users)
+        if (users.length !== 0) {
+            lastCursor = users[users.length - 1].cursor
+        }
+        loadMoreButton.hidden = !hasMore
+    }
+
+    const searchUsers = username => http.get('/api/users?username=' + encodeURIComponent(username)).then(page => {
+        if (page.items.length === 1) {
+            goto('/users/' + page.items[0].username)
+            return
+        }
+        addUsers(page)
+    })
+
+    const searchContent = q => http.get('/api/search?q=' + encodeURIComponent(q)).then(addResults)
+
     searchForm.addEventListener('submit', ev => {
         ev.preventDefault()
-        const username = searchInput.value.trim()
+        const q = searchInput.value.trim()
         searchInput.disabled = true
         searchButton.disabled = true
-        http.get('/api/users?username=' + username).then(users => {
-            if (users.length === 1) {
-                goto('/users/' + users[0].username)
-                return
-            }
-            usersList(resultDiv, users)
-        }).catch(err => {
+        resultDiv.innerHTML = ''
+        loadMoreButton.hidden = true
+        lastQuery = q
+        lastSearch = searchSelect.value
+        lastCursor = undefined
+        const searching = searchSelect.value === 'users' ? searchUsers(q) : searchContent(q)
+        searching.catch(err => {
             console.error(err)
             alert(err.message)
             searchInput.focus()
@@ -47,5 +121,17 @@ export default function () {
         })
     })
 
+    loadMoreButton.addEventListener('click', () => {
+        loadMoreButton.disabled = true
+        const loading = lastSearch === 'users'
+            ? http.get(`/api/users?username=${encodeURIComponent(lastQuery)}&after=${encodeURIComponent(lastCursor)}`).then(addUsers)
+            : http.get(`/api/search?q=${encodeURIComponent(lastQuery)}&before=${encodeURIComponent(lastCursor)}`).then(addResults)
+        loading
+            .catch(console.error)
+            .then(() => {
+                loadMoreButton.disabled = false
+            })
+    })
+
     return page
 }
@@ -0,0 +1,84 @@
+import { getAuthUser } from '../auth.js'
+import { likeable, repostable, spoileable } from '../behaviors.js'
+import http from '../http.js'
+import { ago, avatarImg, commentsMsg, escapeHTML, likesMsg, linkify, mediaHTML, repostsMsg, wrapInSpoiler } from '../utils.js'
+
+const authenticated = getAuthUser() !== null
+
+const template = document.createElement('template')
+template.innerHTML = `
+<div class="container">
+    <h1></h1>
+    <div id="posts" class="articles" role="feed"></div>
+    <button id="load-more" hidden>Load more</button>
+</div>
+`
+
+function createPostArticle(post) {
+    const { user } = post
+    const createdAt = ago(post.createdAt)
+    const content = linkify(escapeHTML(post.content))
+
+    const article = document.createElement('article')
+    article.innerHTML = wrapInSpoiler(post.spoilerOf, `
+        <header>
+            <a href="/users/${user.username}">
+                ${avatarImg(user)}
+                <span>${user.username}</span>
+            </a>
+            <a href="/posts/${post.id}" class="created-at"><time>${createdAt}</time></a>
+        </header>
+        <p>${content}</p>
+        ${mediaHTML(post.media)}
+        <div>
+            <${authenticated ? 'button role="switch"' : 'span'} class="likes-count${post.liked ? ' liked' : ''}" aria-label="${likesMsg(post.likesCount)}"${authenticated ? ` aria-checked="${post.liked}"` : ''}>${post.likesCount}</${authenticated ? 'button' : 'span'}>
+            <a class="comments-count" href="/posts/${post.id}" title="${commentsMsg(post.commentsCount)}">${post.commentsCount}</a>
+            <${authenticated ? 'button role="switch"' : 'span'} class="reposts-count${post.reposted ? ' reposted' : ''}" aria-label="${repostsMsg(post.repostsCount)}"${authenticated ? ` aria-checked="${post.reposted}"` : ''}>${post.repostsCount}</${authenticated ? 'button' : 'span'}>
+        </div>
+    `)
+
+    if (post.spoilerOf !== null) {
+        spoileable(article.querySelector('.spoiler-toggler'))
+    }
+
+    if (authenticated) {
+        likeable(article.querySelector('.likes-count'), `posts/${post.id}`)
+        repostable(article.querySelector('.reposts-count'), post.id)
+    }
+
+    return article
+}
+
+export default function (tag) {
+    tag = decodeURIComponent(tag)
+    const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
+    const postsDiv = page.getElementById('posts')
+    const loadMoreButton = /** @type {HTMLButtonElement} */ (page.getElementById('load-more'))
+    let lastCursor
+
+    page.querySelector('h1').textContent = '#' + tag
+
+    const addPosts = ({ items: posts, hasMore }) => {
+        posts.forEach(post => {
+            postsDiv.appendChild(createPostArticle(post))
+        })
+        if (posts.length !== 0) {
+            lastCursor = posts[posts.length - 1].cursor
+        }
+        loadMoreButton.hidden = !hasMore
+    }
+
+    http.get(`/api/tags/${encodeURIComponent(tag)}/posts`).then(addPosts).catch(console.error)
+
+    loadMoreButton.addEventListener('click', () => {
+        loadMoreButton.disabled = true
+        http.get(`/api/tags/${encodeURIComponent(tag)}/posts?before=${encodeURIComponent(lastCursor)}`)
+            .then(addPosts)
+            .catch(console.error)
+            .then(() => {
+                loadMoreButton.disabled = false
+            })
+    })
+
+    return page
+}
@@ -1,7 +1,7 @@
 import { getAuthUser } from '../auth.js'
 import { followable, likeable, spoileable } from '../behaviors.js'
 import http from '../http.js'
-import { ago, avatarImg, commentsMsg, escapeHTML, followMsg, followersMsg, goto, likesMsg, linkify, wrapInSpoiler } from '../utils.js'
+import { ago, avatarImg, commentsMsg, escapeHTML, followMsg, followersMsg, goto, likesMsg, linkify, mediaHTML, wrapInSpoiler } from '../utils.js'
 
 const authenticated = getAuthUser() !== null
 
@@ -9,6 +9,9 @@ const template = document.createElement('template')
 template.innerHTML = `
 <div class="profile-wrapper"></div>
 <div id="posts" class="container articles" role="feed"></div>
+<div class="container">
+    <button id="load-more" hidden>Load more</button>
+</div>
 `
 
 function createPostArticle(post) {
@@ -26,6 +29,7 @@ function createPostArticle(post) {
             <a href="/posts/${post.id}" class="created-at"><time>${createdAt}</time></a>
         </header>
         <p>${content}</p>
+        ${mediaHTML(post.media)}
         <div>
             <${authenticated ? 'button role="switch"' : 'span'} class="likes-count${post.liked ? ' liked' : ''}" aria-label="${likesMsg(post.likesCount)}"${authenticated ? ` aria-checked="${post.liked}"` : ''}>${post.likesCount}</${authenticated ? 'button' : 'span'}>
             <a class="comments-count" href="/posts/${post.id}" title="${commentsMsg(post.commentsCount)}">${post.commentsCount}</a>
@@ -47,11 +51,36 @@ export default function (username) {
     const page = /** @type {DocumentFragment} */ (template.content.cloneNode(true))
     const profileDiv = page.querySelector('.profile-wrapper')
     const postsDiv = page.getElementById('posts')
+    const loadMoreButton = /** @type {HTMLButtonElement} */ (page.getElementById('load-more'))
+    let user
+    let lastCursor
+
+    const addPosts = ({ items: posts, hasMore }) => {
+        posts.forEach(post => {
+            post['user'] = user
+            postsDiv.appendChild(createPostArticle(post))
+        })
+        if (posts.length !== 0) {
+            lastCursor = posts[posts.length - 1].cursor
+        }
+        loadMoreButton.hidden = !hasMore
+    }
+
+    loadMoreButton.addEventListener('click', () => {
+        loadMoreButton.disabled = true
+        http.get(`/api/users/${username}/posts?before=${encodeURIComponent(lastCursor)}`)
+            .then(addPosts)
+            .catch(console.error)
+            .then(() => {
+                loadMoreButton.disabled = false
+            })
+    })
 
     Promise.all([
         http.get('/api/users/' + username),
         http.get(`/api/users/${username}/posts`)
-    ]).then(([user, posts]) => {
+    ]).then(([profile, posts]) => {
+        user = profile
         profileDiv.innerHTML = `
             <div class="container">
                 <div>
@@ -111,10 +140,7 @@ export default function (username) {
             followable(profileDiv.querySelector('#follow'), user.username)
         }
 
-        posts.forEach(post => {
-            post['user'] = user
-            postsDiv.appendChild(createPostArticle(post))
-        })
+        addPosts(posts)
     }).catch(err => {
         console.error(err)
         if (err.statusCode === 404) {
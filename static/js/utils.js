@@ -1,5 +1,9 @@
+const avatarSrc = (user, big) => typeof user.avatarUrls === 'object'
+    ? user.avatarUrls[big ? 'large' : 'small']
+    : user.avatarUrl
+
 export const avatarImg = (user, big = false) => user.avatarUrl !== null
-    ? `<img class="avatar${big ? ' big' : ''}" src="${user.avatarUrl}" alt="${user.username}">`
+    ? `<img class="avatar${big ? ' big' : ''}" src="${avatarSrc(user, big)}" alt="${user.username}">`
     : `<figure class="avatar${big ? ' big' : ''}" data-initial="${user.username[0]}"></figure>`
 
 /**
@@ -12,6 +16,16 @@ export const likesMsg = x => `${x} like${x !== 1 ? 's' : ''}`
  */
 export const commentsMsg = x => `${x} comment${x !== 1 ? 's' : ''}`
 
+/**
+ * @param {number} x
+ */
+export const repostsMsg = x => `${x} repost${x !== 1 ? 's' : ''}`
+
+/**
+ * @param {number} x
+ */
+export const quotesMsg = x => `${x} quote${x !== 1 ? 's' : ''}`
+
 /**
  * @param {number} x
  */
@@ -58,12 +72,25 @@ export const escapeHTML = html => html
 
 const rxURL = new RegExp('(?:(?:(?:[a-z]+:)?//)|www\\.)(?:localhost|(?:(?:[a-z\\u00a1-\\uffff0-9]-*)*[a-z\\u00a1-\\uffff0-9]+)(?:\\.(?:[a-z\\u00a1-\\uffff0-9]-*)*[a-z\\u00a1-\\uffff0-9]+)*)(?:[/?#][^\\s"]*)?', 'ig')
 
+const rxTag = /(^|\s)#([\p{L}\p{N}_]+)/gu
+
 /**
- * Parses links.
+ * Parses links and hashtags.
  * @param {string} content
  */
 export const linkify = content => content
     .replace(rxURL, url => `<a href="${url}" target="_blank" rel="noopener noreferrer">${decodeURI(url)}</a>`)
+    .replace(rxTag, (_, space, tag) => `${space}<a href="/tags/${encodeURIComponent(tag.toLowerCase())}">#${tag}</a>`)
+
+/**
+ * Renders the images attached to a post.
+ * @param {object[]=} media
+ */
+export const mediaHTML = media => Array.isArray(media) && media.length !== 0 ? `
+    <div class="media">
+        ${media.map(m => `<img src="${m.url}" width="${m.width}" height="${m.height}" alt="${m.altText !== null ? escapeHTML(m.altText).replace(/"/g, '&quot;') : ''}" loading="lazy">`).join('')}
+    </div>
+` : ''
 
 /**
  * Wraps spoileable content.
@@ -150,6 +177,9 @@ export function getNotificationMessage({ actorUsername, verb, objectId, targetId
         case 'post_mention': return actorUsername + ' mentioned you in a post'
         case 'comment': return actorUsername + ' commented on a post'
         case 'comment_mention': return actorUsername + ' mentioned you in a comment'
+        case 'comment_reply': return actorUsername + ' replied to your comment'
+        case 'repost': return actorUsername + ' reposted your post'
+        case 'quote': return actorUsername + ' quoted your post'
     }
     return null
 }
@@ -160,9 +190,12 @@ export function getNotificationMessage({ actorUsername, verb, objectId, targetId
 export function getNotificationHref({ actorUsername, verb, objectId, targetId }) {
     switch (verb) {
         case 'follow': return '/users/' + actorUsername
-        case 'post_mention': return '/posts/' + objectId
+        case 'post_mention':
+        case 'repost':
+        case 'quote': return '/posts/' + objectId
         case 'comment':
-        case 'comment_mention': return `/posts/${targetId}#comment-${objectId}`
+        case 'comment_mention':
+        case 'comment_reply': return `/posts/${targetId}#comment-${objectId}`
     }
     return '#!'
 }
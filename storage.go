@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Storage of public files, like avatars and post media.
+// Names are slash separated paths like "avatars/123-abc-128.jpg".
+type Storage interface {
+	Store(ctx context.Context, name, contentType string, b []byte) error
+	Delete(ctx context.Context, name string) error
+}
+
+var storage Storage
+
+// storageBaseURL is where stored files are publicly served from.
+var storageBaseURL *url.URL
+
+// storageURL builds the public URL of a stored file.
+func storageURL(name string) string {
+	u := *storageBaseURL
+	u.Path = path.Join(u.Path, name)
+	return u.String()
+}
+
+// contentHash is used to name stored files after their content,
+// so a new version gets a new URL and the old one can be cached forever.
+func contentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// diskStorage stores files on disk, served by the app itself.
+type diskStorage struct {
+	dir string
+}
+
+func newDiskStorage(dir string) *diskStorage {
+	return &diskStorage{dir: dir}
+}
+
+// Store writes the file, creating its directory if needed.
+func (s *diskStorage) Store(_ context.Context, name, _ string, b []byte) error {
+	filename := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("could not create storage dir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return fmt.Errorf("could not write file to disc: %v", err)
+	}
+
+	return nil
+}
+
+// Delete removes the file. Removing a missing file is not an error.
+func (s *diskStorage) Delete(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove file from disc: %v", err)
+	}
+
+	return nil
+}
+
+// diskStorageHandler serves the stored files under the given prefix, like "avatars".
+// Requests can't reach outside of it and directories aren't listed.
+func diskStorageHandler(dir, prefix string) http.Handler {
+	return http.StripPrefix("/"+prefix+"/", http.FileServer(filesOnly{
+		http.Dir(filepath.Join(dir, filepath.FromSlash(prefix))),
+	}))
+}
+
+// filesOnly is a file system that refuses to open directories.
+type filesOnly struct {
+	http.FileSystem
+}
+
+func (fs filesOnly) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+
+	return f, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage stores files in a bucket of an S3 compatible service, like MinIO.
+// The bucket must allow public reads, or be behind a CDN.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(ctx context.Context, endpoint, accessKey, secretKey, bucket string, secure bool) (*s3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create s3 client: %v", err)
+	}
+
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not check s3 bucket existence: %v", err)
+	}
+
+	if !exists {
+		return nil, fmt.Errorf("s3 bucket %q does not exist", bucket)
+	}
+
+	return &s3Storage{client: client, bucket: bucket}, nil
+}
+
+// Store puts the object. Objects are never overwritten,
+// so they can be cached forever.
+func (s *s3Storage) Store(ctx context.Context, name, contentType string, b []byte) error {
+	if _, err := s.client.PutObject(ctx, s.bucket, name, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{
+		ContentType:  contentType,
+		CacheControl: "public, max-age=31536000, immutable",
+	}); err != nil {
+		return fmt.Errorf("could not put s3 object: %v", err)
+	}
+
+	return nil
+}
+
+// Delete removes the object. Removing a missing object is not an error.
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("could not remove s3 object: %v", err)
+	}
+
+	return nil
+}
+
+// s3URL is the public URL of the bucket, in path style.
+func s3URL(endpoint, bucket string, secure bool) string {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	return scheme + "://" + endpoint + "/" + bucket + "/"
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a stand-in for MinIO, enough for s3Storage.
+// It keeps objects in memory, serves them publicly and skips authentication.
+type fakeS3 struct {
+	bucket  string
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+}
+
+type fakeS3Object struct {
+	body         []byte
+	contentType  string
+	cacheControl string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 || parts[1] == "" {
+		if _, ok := r.URL.Query()["location"]; ok {
+			io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+				`<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+		}
+		return
+	}
+
+	name := parts[1]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[name] = fakeS3Object{
+			body:         body,
+			contentType:  r.Header.Get("Content-Type"),
+			cacheControl: r.Header.Get("Cache-Control"),
+		}
+		w.Header().Set("ETag", `"`+contentHash(body)[:32]+`"`)
+	case http.MethodGet, http.MethodHead:
+		o, ok := s.objects[name]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", o.contentType)
+		w.Header().Set("Cache-Control", o.cacheControl)
+		w.Write(o.body)
+	case http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// readS3Body decodes the aws-chunked encoding clients use to sign streamed uploads.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(r.Body)
+	}
+
+	var body []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseInt(strings.TrimSpace(strings.SplitN(line, ";", 2)[0]), 16, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return body, nil
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// s3TestStorage connects to the server at S3_ENDPOINT when set, to test against a real MinIO.
+// Its S3_BUCKET must exist and allow anonymous reads.
+// Otherwise an in-process stand-in is started.
+func s3TestStorage(t *testing.T) (*s3Storage, string) {
+	t.Helper()
+
+	endpoint, ok := os.LookupEnv("S3_ENDPOINT")
+	accessKey := os.Getenv("S3_ACCESS_KEY")
+	secretKey := os.Getenv("S3_SECRET_KEY")
+	bucket := env("S3_BUCKET", "nakama")
+	secure := os.Getenv("S3_SECURE") == "true"
+	if !ok {
+		srv := httptest.NewServer(&fakeS3{bucket: bucket, objects: map[string]fakeS3Object{}})
+		t.Cleanup(srv.Close)
+		endpoint = strings.TrimPrefix(srv.URL, "http://")
+		accessKey, secretKey, secure = "minioadmin", "minioadmin", false
+	}
+
+	s, err := newS3Storage(context.Background(), endpoint, accessKey, secretKey, bucket, secure)
+	if err != nil {
+		t.Skipf("s3 not available: %v", err)
+	}
+
+	return s, s3URL(endpoint, bucket, secure)
+}
+
+func TestS3Storage(t *testing.T) {
+	s, baseURL := s3TestStorage(t)
+	ctx := context.Background()
+	name := "avatars/test-" + contentHash([]byte(t.Name()))[:8] + "-128.jpg"
+	body := []byte("avatar")
+
+	if err := s.Store(ctx, name, "image/jpeg", body); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(baseURL + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || !bytes.Equal(b, body) {
+		t.Fatalf("got status %d and body %q, want %q", res.StatusCode, b, body)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("got content type %q", ct)
+	}
+	if cc := res.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("got cache control %q", cc)
+	}
+
+	if err = s.Delete(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = http.Get(baseURL + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d after delete, want %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	// Removing a missing object is fine.
+	if err = s.Delete(ctx, name); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewS3StorageMissingBucket(t *testing.T) {
+	if _, ok := os.LookupEnv("S3_ENDPOINT"); ok {
+		t.Skip("only against the stand-in")
+	}
+
+	srv := httptest.NewServer(&fakeS3{bucket: "nakama", objects: map[string]fakeS3Object{}})
+	defer srv.Close()
+
+	endpoint := strings.TrimPrefix(srv.URL, "http://")
+	if _, err := newS3Storage(context.Background(), endpoint, "minioadmin", "minioadmin", "missing", false); err == nil {
+		t.Error("got no error for a missing bucket")
+	}
+}
+
+func TestS3URL(t *testing.T) {
+	u, err := url.Parse(s3URL("127.0.0.1:9000", "nakama", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevBaseURL := storageBaseURL
+	defer func() { storageBaseURL = prevBaseURL }()
+	storageBaseURL = u
+
+	if got, want := storageURL("media/abc.png"), "https://127.0.0.1:9000/nakama/media/abc.png"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStorageHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nakama-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newDiskStorage(dir)
+	ctx := context.Background()
+	if err = s.Store(ctx, "avatars/1-abc-128.jpg", "image/jpeg", []byte("avatar")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Store(ctx, "media/abc.png", "image/png", []byte("media")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := diskStorageHandler(dir, "avatars")
+	tt := []struct {
+		path string
+		code int
+		body string
+	}{
+		{path: "/avatars/1-abc-128.jpg", code: http.StatusOK, body: "avatar"},
+		{path: "/avatars/missing.jpg", code: http.StatusNotFound},
+		{path: "/avatars/", code: http.StatusNotFound},
+		{path: "/avatars/../secret.txt", code: http.StatusNotFound},
+		{path: "/avatars/../media/abc.png", code: http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.code {
+				t.Errorf("got status %d, want %d", rec.Code, tc.code)
+			}
+			if tc.body != "" && rec.Body.String() != tc.body {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tc.body)
+			}
+		})
+	}
+}
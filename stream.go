@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseReplayLimit bounds how many missed events get replayed on reconnect.
+const sseReplayLimit = 100
+
+// streamMaxPosts bounds how many post streams /api/stream serves.
+// Post ids past it are ignored.
+const streamMaxPosts = 50
+
+// replayFunc returns the messages of a topic with an id greater than lastEventID,
+// oldest first. Topics without ids, like counters, have none.
+type replayFunc func(ctx context.Context, lastEventID string) ([]Message, error)
+
+// sseStream is one of the topics served by streamSSE.
+// Event is the SSE event name; empty means the default "message".
+// Messages caused by skipActorID are not sent.
+type sseStream struct {
+	topic       string
+	event       string
+	skipActorID string
+	replay      replayFunc
+}
+
+// getStream multiplexes several realtime streams over a single SSE connection,
+// each one sent with its own event name.
+// Authenticated users get "feed" and "notification" events;
+// every post_id query param adds "comment" and "counters" events of that post,
+// so it can be used for the post being viewed and for the posts in the feed.
+func getStream(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+
+	streams := make([]sseStream, 0)
+	if authenticated {
+		streams = append(streams,
+			sseStream{
+				topic: feedTopic(authUserID),
+				event: "feed",
+				replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+					return feedSince(ctx, authUserID, lastEventID)
+				},
+			},
+			sseStream{
+				topic: notificationsTopic(authUserID),
+				event: "notification",
+				replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+					return notificationsSince(ctx, authUserID, lastEventID)
+				},
+			},
+		)
+	}
+
+	seen := make(map[string]struct{})
+	for _, postID := range r.URL.Query()["post_id"] {
+		postID := strings.TrimSpace(postID)
+		if _, ok := seen[postID]; ok || postID == "" {
+			continue
+		}
+		if len(seen) == streamMaxPosts {
+			break
+		}
+		seen[postID] = struct{}{}
+
+		streams = append(streams, sseStream{
+			topic:       commentsTopic(postID),
+			event:       "comment",
+			skipActorID: authUserID,
+			replay: func(ctx context.Context, lastEventID string) ([]Message, error) {
+				return commentsSince(ctx, postID, authUserID, lastEventID)
+			},
+		}, sseStream{
+			topic: postTopic(postID),
+			event: "counters",
+		})
+	}
+
+	if len(streams) == 0 {
+		http.Error(w, "Nothing to stream", http.StatusBadRequest)
+		return
+	}
+
+	streamSSE(w, r, streams...)
+}
+
+// streamSSE subscribes to the streams topics and writes every message as a server-sent event.
+// When the client reconnects with a Last-Event-ID header,
+// whatever each replay returns is sent first so nothing published in between is lost.
+// Clients opening a new connection, like when changing the streamed posts,
+// can't set the header, so a last_event_id query param is taken too.
+// Ids are serial, so a single Last-Event-ID is good for several tables.
+func streamSSE(w http.ResponseWriter, r *http.Request, streams ...sseStream) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+
+	topics := make([]string, len(streams))
+	byTopic := make(map[string]sseStream, len(streams))
+	for i, stream := range streams {
+		topics[i] = stream.topic
+		byTopic[stream.topic] = stream
+	}
+
+	// Subscribe before replaying so nothing falls between the two.
+	ch, unsubscribe := broker.subscribe(topics...)
+	defer unsubscribe()
+
+	// Last sent id per topic.
+	lastIDs := make(map[string]int64, len(streams))
+	replayed := make([]Message, 0)
+	lastEventID := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if lastEventID == "" {
+		lastEventID = strings.TrimSpace(r.URL.Query().Get("last_event_id"))
+	}
+	if lastEventID != "" {
+		if id, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+			for _, stream := range streams {
+				if stream.replay == nil {
+					continue
+				}
+				msgs, err := stream.replay(ctx, lastEventID)
+				if err != nil {
+					respondError(w, fmt.Errorf("could not replay %s: %v", stream.topic, err))
+					return
+				}
+				replayed = append(replayed, msgs...)
+				lastIDs[stream.topic] = id
+			}
+		}
+	}
+	sort.SliceStable(replayed, func(i, j int) bool {
+		return messageID(replayed[i]) < messageID(replayed[j])
+	})
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("Content-Type", "text/event-stream")
+
+	for _, msg := range replayed {
+		writeSSE(w, byTopic[msg.Topic].event, msg)
+		if id := messageID(msg); id > lastIDs[msg.Topic] {
+			lastIDs[msg.Topic] = id
+		}
+	}
+	f.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-shuttingDown:
+			// The client reconnects, to another instance if need be.
+			return
+		case <-time.After(time.Second * 15):
+			fmt.Fprint(w, "ping: \n\n")
+			f.Flush()
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			stream := byTopic[msg.Topic]
+			if stream.skipActorID != "" && msg.ActorID == stream.skipActorID {
+				continue
+			}
+			// Already sent while replaying.
+			if id := messageID(msg); id != 0 && id <= lastIDs[msg.Topic] {
+				continue
+			}
+			writeSSE(w, stream.event, msg)
+			f.Flush()
+		}
+	}
+}
+
+// messageID parses the message id, zero if it has none.
+func messageID(msg Message) int64 {
+	id, _ := strconv.ParseInt(msg.ID, 10, 64)
+	return id
+}
+
+func writeSSE(w io.Writer, event string, msg Message) {
+	if msg.Event != "" {
+		event = msg.Event
+	}
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	if msg.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", msg.ID)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", msg.Data)
+}
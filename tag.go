@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gernest/mention"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+)
+
+const (
+	// trendingTagsWindow is how far back posts count for trending tags.
+	trendingTagsWindow       = time.Hour * 24
+	defaultTrendingTagsLimit = 10
+	maxTrendingTagsLimit     = 50
+)
+
+// TrendingTag model
+type TrendingTag struct {
+	Tag        string `json:"tag"`
+	PostsCount int    `json:"postsCount"`
+}
+
+// collectTags returns the unique hashtags of the content, lowercased and without the #.
+func collectTags(content string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range mention.GetTagsAsUniqueStrings('#', content, ',', '.', '!', '?', '"', ')', '#') {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// normalizeTag lowercases the tag, dropping a leading #.
+// Tags are made of letters, digits and underscores; empty if not valid.
+func normalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return ""
+		}
+	}
+	return tag
+}
+
+// setPostTags replaces the tags of the post with the ones in its content.
+func setPostTags(tx *sql.Tx, postID, content string, createdAt time.Time) error {
+	if _, err := tx.Exec("DELETE FROM post_tags WHERE post_id = $1", postID); err != nil {
+		return err
+	}
+
+	tags := collectTags(content)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO post_tags (post_id, tag, created_at)
+		SELECT $1, unnest($2::STRING[]), $3
+		RETURNING NOTHING
+	`, postID, pq.Array(tags), createdAt)
+	return err
+}
+
+// getTagPosts lists the posts with the given tag, newest first.
+func getTagPosts(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs == nil {
+		errs = page.cursorErrs()
+	}
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+	tag := normalizeTag(chi.URLParam(r, "tag"))
+	if tag == "" {
+		respondJSON(w, map[string]string{
+			"tag": "Invalid tag",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	query := `
+		SELECT
+			posts.id,
+			posts.content,
+			posts.spoiler_of,
+			posts.likes_count,
+			posts.comments_count,
+			posts.reposts_count,
+			posts.quotes_count,
+			posts.quote_of_id,
+			posts.created_at,
+			posts.edited_at,
+			users.username,
+			users.avatar_url`
+	args := []interface{}{tag}
+	if authenticated {
+		query += `,
+			posts.user_id = $2 AS mine,
+			likes.user_id IS NOT NULL AS liked,
+			reposts.user_id IS NOT NULL AS reposted,
+			subscriptions.user_id IS NOT NULL AS subscribed`
+		args = append(args, authUserID)
+	}
+	query += `
+		FROM post_tags
+		INNER JOIN posts ON post_tags.post_id = posts.id
+		INNER JOIN users ON posts.user_id = users.id`
+	if authenticated {
+		query += `
+			LEFT JOIN post_likes AS likes
+				ON likes.user_id = $2
+				AND likes.post_id = posts.id
+			LEFT JOIN reposts
+				ON reposts.user_id = $2
+				AND reposts.post_id = posts.id
+			LEFT JOIN subscriptions
+				ON subscriptions.user_id = $2
+				AND subscriptions.post_id = posts.id`
+	}
+	query += `
+		WHERE post_tags.tag = $1`
+	conds, args := page.cursorConds("post_tags.created_at", "post_tags.post_id", args)
+	query += conds
+	query += page.orderBy(true, "post_tags.created_at DESC", "post_tags.post_id DESC")
+	limit, args := page.limit(args)
+	query += limit
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query tag posts: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	posts := make([]Post, 0, page.Limit+1)
+	for rows.Next() {
+		var user User
+		var post Post
+		dest := []interface{}{
+			&post.ID,
+			&post.Content,
+			&post.SpoilerOf,
+			&post.LikesCount,
+			&post.CommentsCount,
+			&post.RepostsCount,
+			&post.QuotesCount,
+			&post.QuoteOfID,
+			&post.CreatedAt,
+			&post.EditedAt,
+			&user.Username,
+			&user.AvatarURL,
+		}
+		if authenticated {
+			dest = append(dest,
+				&post.Mine,
+				&post.Liked,
+				&post.Reposted,
+				&post.Subscribed,
+			)
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			respondError(w, fmt.Errorf("could not scan tag post: %v", err))
+			return
+		}
+
+		// Tagged when the post was created, so it sorts by the same time.
+		post.Cursor = encodeCursor(post.CreatedAt, post.ID)
+		post.User = &user
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over tag posts: %v", err))
+		return
+	}
+
+	n, hasMore := page.trim(true, posts)
+	posts = posts[:n]
+
+	if err = withPostsMedia(ctx, postPointers(posts)); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	respondJSON(w, Page{posts, hasMore}, http.StatusOK)
+}
+
+// getTrendingTags lists the tags used by the most posts
+// created within the last trendingTagsWindow.
+func getTrendingTags(w http.ResponseWriter, r *http.Request) {
+	limit := defaultTrendingTagsLimit
+	if s := strings.TrimSpace(r.URL.Query().Get("limit")); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxTrendingTagsLimit {
+			respondJSON(w, map[string]string{
+				"limit": "Limit must be between 1 and " + strconv.Itoa(maxTrendingTagsLimit),
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT tag, count(*) AS posts_count
+		FROM post_tags
+		WHERE created_at > now() - $1 * INTERVAL '1 second'
+		GROUP BY tag
+		ORDER BY posts_count DESC, tag ASC
+		LIMIT $2
+	`, int(trendingTagsWindow.Seconds()), limit)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query trending tags: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	tags := make([]TrendingTag, 0, limit)
+	for rows.Next() {
+		var tag TrendingTag
+		if err = rows.Scan(&tag.Tag, &tag.PostsCount); err != nil {
+			respondError(w, fmt.Errorf("could not scan trending tag: %v", err))
+			return
+		}
+		tags = append(tags, tag)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over trending tags: %v", err))
+		return
+	}
+
+	respondJSON(w, tags, http.StatusOK)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  string
+		want string
+	}{
+		{"plain", "golang", "golang"},
+		{"lowercased", "GoLang", "golang"},
+		{"leading hash", "#go", "go"},
+		{"trimmed", "  go\n", "go"},
+		{"digits", "go118", "go118"},
+		{"underscore", "go_lang", "go_lang"},
+		{"unicode letters", "Café", "café"},
+		{"empty", "", ""},
+		{"only hash", "#", ""},
+		{"dash", "go-lang", ""},
+		{"dot", "go.dev", ""},
+		{"inner hash", "go#rust", ""},
+		{"emoji", "go🚀", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeTag(tt.tag); got != tt.want {
+				t.Errorf("normalizeTag(%q) = %q, want %q", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"none", "no tags here", []string{}},
+		{"single", "hello #world", []string{"world"}},
+		{"lowercased", "#Go and #RUST", []string{"go", "rust"}},
+		{"deduplicated", "#go #Go #GO", []string{"go"}},
+		{"punctuation", "learning #go, #rust. #zig!", []string{"go", "rust", "zig"}},
+		{"hash terminator", "#go# is fun", []string{"go"}},
+		{"invalid dropped", "#go-lang #ok", []string{"ok"}},
+		{"bare hash", "# heading", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collectTags(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collectTags(%q) = %v, want %v", tt.content, got, tt.want)
+			}
+		})
+	}
+}
@@ -9,12 +9,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"mime"
 	"net/http"
-	"os"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/go-chi/chi"
@@ -39,6 +39,7 @@ type Profile struct {
 	Me              bool      `json:"me"`
 	FollowerOfMine  bool      `json:"followerOfMine"`
 	FollowingOfMine bool      `json:"followingOfMine"`
+	Cursor          string    `json:"cursor,omitempty"`
 }
 
 // CreateUserInput request body
@@ -53,10 +54,45 @@ type ToggleFollowPayload struct {
 	FollowersCount  int  `json:"followersCount"`
 }
 
+var (
+	rxEmail    = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+	rxUsername = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,14}$`)
+)
+
+const emailMaxLength = 128
+
+const (
+	defaultAutocompleteLimit = 5
+	maxAutocompleteLimit     = 10
+)
+
+func validateEmail(email string) string {
+	if email == "" {
+		return "Email required"
+	}
+	if utf8.RuneCountInString(email) > emailMaxLength || !rxEmail.MatchString(email) {
+		return "Invalid email"
+	}
+	return ""
+}
+
 // Validate user input
 func (input *CreateUserInput) Validate() map[string]string {
-	// TODO: actual validation
-	return nil
+	errs := make(map[string]string)
+
+	input.Email = strings.TrimSpace(input.Email)
+	if err := validateEmail(input.Email); err != "" {
+		errs["email"] = err
+	}
+
+	input.Username = strings.TrimSpace(input.Username)
+	if input.Username == "" {
+		errs["username"] = "Username required"
+	} else if !rxUsername.MatchString(input.Username) {
+		errs["username"] = "Invalid username"
+	}
+
+	return errs
 }
 
 var errFollowingMyself = errors.New("Try following someone else")
@@ -105,11 +141,32 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, user, http.StatusCreated)
 }
 
-// TODO: add pagination
 func getUsers(w http.ResponseWriter, r *http.Request) {
-	username := strings.TrimSpace(r.URL.Query().Get("username"))
-	users, err := getUsersWhere(r.Context(),
-		"users.username ILIKE '%' || $1 || '%'", username)
+	q := r.URL.Query()
+	page, errs := parsePageParams(q)
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	errs = make(map[string]string)
+	if page.Before != "" {
+		if _, _, _, _, err := decodeUserRankCursor(page.Before); err != nil {
+			errs["before"] = "Invalid cursor"
+		}
+	}
+	if page.After != "" {
+		if _, _, _, _, err := decodeUserRankCursor(page.After); err != nil {
+			errs["after"] = "Invalid cursor"
+		}
+	}
+	if len(errs) != 0 {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
+	username := strings.TrimSpace(q.Get("username"))
+	users, err := searchUsers(r.Context(), username, page)
 	if err != nil {
 		respondError(w, err)
 		return
@@ -118,6 +175,215 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, users, http.StatusOK)
 }
 
+// getUsersAutocomplete returns a few users whose username starts with the prefix,
+// ranked like searchUsers. Meant to complete mentions.
+func getUsersAutocomplete(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := strings.TrimPrefix(strings.TrimSpace(q.Get("prefix")), "@")
+	if prefix == "" {
+		respondJSON(w, map[string]string{
+			"prefix": "Prefix required",
+		}, http.StatusUnprocessableEntity)
+		return
+	}
+
+	limit := defaultAutocompleteLimit
+	if s := strings.TrimSpace(q.Get("limit")); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxAutocompleteLimit {
+			respondJSON(w, map[string]string{
+				"limit": "Limit must be between 1 and " + strconv.Itoa(maxAutocompleteLimit),
+			}, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+	args := []interface{}{prefix, escapeLike(prefix)}
+	where := "lower(users.username) LIKE lower($2) || '%'"
+	if authenticated {
+		args = append(args, authUserID)
+		// Nobody mentions themselves.
+		where += " AND users.id != $3"
+	}
+	args = append(args, limit)
+
+	rows, err := db.QueryContext(ctx, rankedUsersQuery(authenticated, where)+fmt.Sprintf(`
+		SELECT username, avatar_url
+		FROM ranked
+		ORDER BY match_rank DESC, relation_rank DESC, followers_count DESC, username ASC
+		LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		respondError(w, fmt.Errorf("could not query users autocomplete: %v", err))
+		return
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, limit)
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.Username, &user.AvatarURL); err != nil {
+			respondError(w, fmt.Errorf("could not scan autocompleted user: %v", err))
+			return
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, fmt.Errorf("could not iterate over autocompleted users: %v", err))
+		return
+	}
+
+	respondJSON(w, users, http.StatusOK)
+}
+
+// rankedUsersQuery builds a "ranked" CTE of the users matching where,
+// which can use $1 as the search term and $2 as it escaped for LIKE.
+// The auth user, if any, goes as $3.
+// match_rank is 3 for exact matches, 2 for prefix matches and 1 for the rest.
+// relation_rank is 2 for users the auth user follows, plus 1 if they follow them back.
+func rankedUsersQuery(authenticated bool, where string) string {
+	query := `
+		WITH ranked AS (
+			SELECT
+				users.username,
+				users.avatar_url,
+				users.followers_count,
+				users.following_count,
+				users.created_at,
+				CASE
+					WHEN lower(users.username) = lower($1) THEN 3
+					WHEN lower(users.username) LIKE lower($2) || '%' THEN 2
+					ELSE 1
+				END AS match_rank`
+	if authenticated {
+		query += `,
+				following.following_id IS NOT NULL AS follower_of_mine,
+				followers.follower_id IS NOT NULL AS following_of_mine,
+				(CASE WHEN followers.follower_id IS NOT NULL THEN 2 ELSE 0 END)
+					+ (CASE WHEN following.following_id IS NOT NULL THEN 1 ELSE 0 END) AS relation_rank
+			FROM users
+			LEFT JOIN follows AS followers
+				ON followers.follower_id = $3
+				AND followers.following_id = users.id
+			LEFT JOIN follows AS following
+				ON following.follower_id = users.id
+				AND following.following_id = $3
+			WHERE ` + where
+	} else {
+		query += `,
+				0 AS relation_rank
+			FROM users
+			WHERE ` + where
+	}
+	return query + `
+		)`
+}
+
+// searchUsers returns a page of the users whose username contains the given one,
+// exact and prefix matches first, then the ones related to the auth user.
+// To paginate pass the cursor of the last user as "after".
+// The cursors must be validated with decodeUserRankCursor first.
+func searchUsers(ctx context.Context, username string, page PageParams) (Page, error) {
+	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
+
+	args := []interface{}{username, escapeLike(username)}
+	if authenticated {
+		args = append(args, authUserID)
+	}
+
+	query := rankedUsersQuery(authenticated, "users.username ILIKE '%' || $2 || '%'") + `
+		SELECT
+			username,
+			avatar_url,
+			followers_count,
+			following_count,
+			created_at,
+			match_rank,
+			relation_rank`
+	if authenticated {
+		query += `,
+			follower_of_mine,
+			following_of_mine`
+	}
+	query += `
+		FROM ranked`
+
+	// Ranks sort descending and usernames ascending;
+	// negating the ranks lets a single tuple comparison follow that order.
+	// The cursor carries the whole sort key, so it doesn't depend on the user still matching.
+	const sortKey = "(-match_rank, -relation_rank, -followers_count, username)"
+	if page.After != "" {
+		matchRank, relationRank, followersCount, username, _ := decodeUserRankCursor(page.After)
+		args = append(args, -matchRank, -relationRank, -followersCount, username)
+		query += fmt.Sprintf(`
+		WHERE %s > ($%d, $%d, $%d, $%d)`, sortKey, len(args)-3, len(args)-2, len(args)-1, len(args))
+	}
+	if page.Before != "" {
+		matchRank, relationRank, followersCount, username, _ := decodeUserRankCursor(page.Before)
+		args = append(args, -matchRank, -relationRank, -followersCount, username)
+		if page.After != "" {
+			query += `
+			AND`
+		} else {
+			query += `
+		WHERE`
+		}
+		query += fmt.Sprintf(` %s < ($%d, $%d, $%d, $%d)`, sortKey, len(args)-3, len(args)-2, len(args)-1, len(args))
+	}
+	query += page.orderBy(false, "match_rank DESC", "relation_rank DESC", "followers_count DESC", "username ASC")
+	limit, args := page.limit(args)
+	query += limit
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Page{}, fmt.Errorf("could not query users search: %v", err)
+	}
+	defer rows.Close()
+
+	users := make([]Profile, 0, page.Limit+1)
+	for rows.Next() {
+		var user Profile
+		var matchRank, relationRank int
+		dest := []interface{}{
+			&user.Username,
+			&user.AvatarURL,
+			&user.FollowersCount,
+			&user.FollowingCount,
+			&user.CreatedAt,
+			&matchRank,
+			&relationRank,
+		}
+		if authenticated {
+			dest = append(dest,
+				&user.FollowerOfMine,
+				&user.FollowingOfMine,
+			)
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			return Page{}, fmt.Errorf("could not scan user: %v", err)
+		}
+
+		user.Cursor = encodeUserRankCursor(matchRank, relationRank, user.FollowersCount, user.Username)
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return Page{}, fmt.Errorf("could not iterate over users: %v", err)
+	}
+
+	n, hasMore := page.trim(false, users)
+	users = users[:n]
+
+	return Page{users, hasMore}, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 func getUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
@@ -185,6 +451,15 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, user, http.StatusOK)
 }
 
+func userByID(ctx context.Context, userID string) (User, error) {
+	user := User{ID: userID}
+	err := db.QueryRowContext(ctx, `
+		SELECT username, avatar_url FROM users WHERE id = $1
+	`, userID).Scan(&user.Username, &user.AvatarURL)
+	return user, err
+}
+
+// uploadAvatar resizes the image to the avatarSizes and sets it as the auth user's avatar.
 func uploadAvatar(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, 4<<20)
 	b, err := ioutil.ReadAll(r.Body)
@@ -201,36 +476,57 @@ func uploadAvatar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	extensions, err := mime.ExtensionsByType(ct)
-	if err != nil {
-		respondError(w, fmt.Errorf("could not get avatar extension: %v", err))
+	variants, err := processAvatar(b)
+	if err == errAvatarTooBig {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 		return
-	}
-	if extensions == nil || len(extensions) == 0 {
-		respondError(w, errors.New("could not get avatar extension"))
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
 		return
 	}
-	ext := extensions[0]
 
 	ctx := r.Context()
 	authUser := ctx.Value(keyAuthUser).(User)
 
-	if err := ioutil.WriteFile(filepath.Join("avatars", authUser.ID+ext), b, os.ModePerm); err != nil {
-		respondError(w, fmt.Errorf("could not write avatar to disc: %v", err))
+	// Named after the upload, so a new avatar gets new URLs.
+	base := "avatars/" + authUser.ID + "-" + contentHash(b)
+	for size, variant := range variants {
+		if err = storage.Store(ctx, base+avatarSuffix(size), "image/jpeg", variant); err != nil {
+			respondError(w, fmt.Errorf("could not store avatar: %v", err))
+			return
+		}
 	}
 
-	// TODO: correctly build avatar URL
-	avatarURL := "http://localhost/avatars/" + authUser.ID + ext
+	avatar := base + avatarSuffix(avatarSizeMedium)
 
-	if _, err := db.ExecContext(ctx, `
-		UPDATE users SET avatar_url = $1
-		WHERE id = $2
-	`, avatarURL, authUser.ID); err != nil {
-		respondError(w, fmt.Errorf("could not update avatar_url: %v", err))
+	var prevAvatar *string
+	if err = crdb.ExecuteTx(ctx, db, nil, func(tx *sql.Tx) error {
+		if err := tx.QueryRow("SELECT avatar_url FROM users WHERE id = $1", authUser.ID).
+			Scan(&prevAvatar); err != nil {
+			return err
+		}
+
+		// Avatars saved as absolute URLs aren't ours to remove.
+		if prevAvatar != nil && strings.Contains(*prevAvatar, "://") {
+			prevAvatar = nil
+		}
+
+		_, err := tx.Exec("UPDATE users SET avatar_url = $1 WHERE id = $2", avatar, authUser.ID)
+		return err
+	}); err != nil {
+		if prevAvatar == nil || *prevAvatar != avatar {
+			removeAvatarFiles(ctx, avatar)
+		}
+		respondError(w, fmt.Errorf("could not update avatar: %v", err))
 		return
 	}
 
-	io.WriteString(w, avatarURL)
+	if prevAvatar != nil && *prevAvatar != avatar {
+		removeAvatarFiles(ctx, *prevAvatar)
+	}
+
+	io.WriteString(w, storageURL(avatar))
 }
 
 func toggleFollow(w http.ResponseWriter, r *http.Request) {
@@ -277,11 +573,15 @@ func toggleFollow(w http.ResponseWriter, r *http.Request) {
 				return err
 			}
 
-			return tx.QueryRow(`
+			if err := tx.QueryRow(`
 				UPDATE users SET followers_count = followers_count - 1
 				WHERE id = $1
 				RETURNING followers_count
-			`, userID).Scan(&followersCount)
+			`, userID).Scan(&followersCount); err != nil {
+				return err
+			}
+
+			return enqueueJob(tx, "feed_prune", followJobPayload{authUser.ID, userID})
 		}
 
 		if _, err := tx.Exec(`
@@ -300,11 +600,19 @@ func toggleFollow(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		return tx.QueryRow(`
+		if err := tx.QueryRow(`
 			UPDATE users SET followers_count = followers_count + 1
 			WHERE id = $1
 			RETURNING followers_count
-		`, userID).Scan(&followersCount)
+		`, userID).Scan(&followersCount); err != nil {
+			return err
+		}
+
+		if err := enqueueJob(tx, "follow_notification", followJobPayload{authUser.ID, userID}); err != nil {
+			return err
+		}
+
+		return enqueueJob(tx, "feed_backfill", followJobPayload{authUser.ID, userID})
 	}); err == errFollowingMyself {
 		http.Error(w,
 			http.StatusText(http.StatusForbidden),
@@ -317,21 +625,25 @@ func toggleFollow(w http.ResponseWriter, r *http.Request) {
 
 	followingOfMine = !followingOfMine
 
-	if followingOfMine {
-		go createFollowNotification(authUser, userID)
-	}
+	jobWorkers.notify()
 
 	respondJSON(w, ToggleFollowPayload{followingOfMine, followersCount}, http.StatusOK)
 }
 
 func getFollowers(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
 	users, err := getUsersWhere(r.Context(), `users.id IN (
 		SELECT follower_id
 		FROM follows
 		WHERE following_id = (
 			SELECT id FROM users WHERE username = $1
 		)
-	)`, chi.URLParam(r, "username"))
+	)`, chi.URLParam(r, "username"), page)
 	if err != nil {
 		respondError(w, err)
 		return
@@ -341,13 +653,19 @@ func getFollowers(w http.ResponseWriter, r *http.Request) {
 }
 
 func getFollowing(w http.ResponseWriter, r *http.Request) {
+	page, errs := parsePageParams(r.URL.Query())
+	if errs != nil {
+		respondJSON(w, errs, http.StatusUnprocessableEntity)
+		return
+	}
+
 	users, err := getUsersWhere(r.Context(), `users.id IN (
 		SELECT following_id
 		FROM follows
 		WHERE follower_id = (
 			SELECT id FROM users WHERE username = $1
 		)
-	)`, chi.URLParam(r, "username"))
+	)`, chi.URLParam(r, "username"), page)
 	if err != nil {
 		respondError(w, err)
 		return
@@ -356,7 +674,9 @@ func getFollowing(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, users, http.StatusOK)
 }
 
-func getUsersWhere(ctx context.Context, where, username string) ([]Profile, error) {
+// getUsersWhere returns a page of users sorted by username.
+// where can use $1 as the given username.
+func getUsersWhere(ctx context.Context, where, username string, page PageParams) (Page, error) {
 	authUserID, authenticated := ctx.Value(keyAuthUserID).(string)
 
 	query := `
@@ -383,21 +703,32 @@ func getUsersWhere(ctx context.Context, where, username string) ([]Profile, erro
 			LEFT JOIN follows AS following
 				ON following.follower_id = users.id
 				AND following.following_id = $2
-			WHERE users.id != $2 AND`
+			WHERE`
 	} else {
 		query += `
 			WHERE`
 	}
 
-	query += fmt.Sprintf(" %s\nORDER BY users.username", where)
+	query += " " + where
+	if page.After != "" {
+		args = append(args, page.After)
+		query += fmt.Sprintf(" AND users.username > $%d", len(args))
+	}
+	if page.Before != "" {
+		args = append(args, page.Before)
+		query += fmt.Sprintf(" AND users.username < $%d", len(args))
+	}
+	query += page.orderBy(false, "users.username ASC")
+	limit, args := page.limit(args)
+	query += limit
 
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("could not query users: %v", err)
+		return Page{}, fmt.Errorf("could not query users: %v", err)
 	}
 	defer rows.Close()
 
-	users := make([]Profile, 0)
+	users := make([]Profile, 0, page.Limit+1)
 	for rows.Next() {
 		var user Profile
 		dest := []interface{}{
@@ -415,15 +746,18 @@ func getUsersWhere(ctx context.Context, where, username string) ([]Profile, erro
 		}
 
 		if err = rows.Scan(dest...); err != nil {
-			return nil, fmt.Errorf("could not scan user: %v", err)
+			return Page{}, fmt.Errorf("could not scan user: %v", err)
 		}
 
 		users = append(users, user)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("could not iterate over users: %v", err)
+		return Page{}, fmt.Errorf("could not iterate over users: %v", err)
 	}
 
-	return users, nil
+	n, hasMore := page.trim(false, users)
+	users = users[:n]
+
+	return Page{users, hasMore}, nil
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCreateUserInputValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		username string
+		want     map[string]string
+	}{
+		{"valid", "john@example.org", "john", map[string]string{}},
+		{"trimmed", " john@example.org ", " john_doe-1 ", map[string]string{}},
+		{"empty", "", "", map[string]string{"email": "Email required", "username": "Username required"}},
+		{"invalid email", "john", "john", map[string]string{"email": "Invalid email"}},
+		{"email too long", strings.Repeat("a", emailMaxLength-5) + "@a.org", "john", map[string]string{"email": "Invalid email"}},
+		{"blank username", "john@example.org", "  ", map[string]string{"username": "Username required"}},
+		{"username starts with digit", "john@example.org", "1john", map[string]string{"username": "Invalid username"}},
+		{"username with spaces", "john@example.org", "john doe", map[string]string{"username": "Invalid username"}},
+		{"username with symbols", "john@example.org", "john!", map[string]string{"username": "Invalid username"}},
+		{"username min length", "john@example.org", "j", map[string]string{}},
+		{"username max length", "john@example.org", "j" + strings.Repeat("a", 14), map[string]string{}},
+		{"username too long", "john@example.org", "j" + strings.Repeat("a", 15), map[string]string{"username": "Invalid username"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := CreateUserInput{Email: tt.email, Username: tt.username}
+			if got := input.Validate(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+			if input.Email != strings.TrimSpace(tt.email) || input.Username != strings.TrimSpace(tt.username) {
+				t.Errorf("input not trimmed: %+v", input)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = time.Second * 10
+	wsPongWait       = time.Second * 60
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxCommandSize = 512
+)
+
+// WSCommand sent by websocket clients to manage their subscriptions.
+// Type is "subscribe" or "unsubscribe";
+// Stream is "feed", "notifications", "comments" or "post";
+// the last two take a PostID and "post" delivers its counters.
+type WSCommand struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream"`
+	PostID string `json:"postId,omitempty"`
+}
+
+// WSEvent sent to websocket clients.
+// Data holds the same payload the SSE endpoints send.
+// Type is set for events other than the usual ones of the stream, like "post_deleted".
+type WSEvent struct {
+	Stream string          `json:"stream,omitempty"`
+	Type   string          `json:"type,omitempty"`
+	PostID string          `json:"postId,omitempty"`
+	ID     string          `json:"id,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Same-origin check by default, as auth relies on the jwt cookie.
+var upgrader = websocket.Upgrader{}
+
+func (cmd WSCommand) topic(authUserID string) string {
+	switch cmd.Stream {
+	case "feed":
+		return feedTopic(authUserID)
+	case "notifications":
+		return notificationsTopic(authUserID)
+	case "comments":
+		if postID := strings.TrimSpace(cmd.PostID); postID != "" {
+			return commentsTopic(postID)
+		}
+	case "post":
+		if postID := strings.TrimSpace(cmd.PostID); postID != "" {
+			return postTopic(postID)
+		}
+	}
+	return ""
+}
+
+type wsSubscription struct {
+	unsubscribe func()
+	stopped     chan struct{}
+}
+
+// serveWS multiplexes the realtime streams of the auth user over one websocket.
+// Clients send WSCommand messages and receive WSEvent messages.
+// A client too slow to keep up gets disconnected, same as with SSE.
+func serveWS(w http.ResponseWriter, r *http.Request) {
+	authUserID := r.Context().Value(keyAuthUserID).(string)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("could not upgrade websocket: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	events := make(chan WSEvent, clientBufferSize)
+	quit := make(chan struct{})
+	defer close(quit)
+	writerDone := make(chan struct{})
+
+	go func() {
+		wsWriteLoop(conn, events, quit)
+		close(writerDone)
+	}()
+
+	respond := func(ev WSEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-writerDone:
+			return false
+		}
+	}
+
+	subscriptions := make(map[string]wsSubscription)
+	defer func() {
+		for _, sub := range subscriptions {
+			close(sub.stopped)
+			sub.unsubscribe()
+		}
+	}()
+
+	conn.SetReadLimit(wsMaxCommandSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var cmd WSCommand
+		if err := conn.ReadJSON(&cmd); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("could not read websocket command: %v\n", err)
+			}
+			return
+		}
+
+		topic := cmd.topic(authUserID)
+		if topic == "" {
+			if !respond(WSEvent{Stream: cmd.Stream, Error: "Unknown stream"}) {
+				return
+			}
+			continue
+		}
+
+		switch cmd.Type {
+		case "subscribe":
+			if _, ok := subscriptions[topic]; ok {
+				continue
+			}
+			ch, unsubscribe := broker.subscribe(topic)
+			sub := wsSubscription{unsubscribe, make(chan struct{})}
+			subscriptions[topic] = sub
+			go wsForward(conn, cmd, authUserID, ch, sub.stopped, events, quit)
+		case "unsubscribe":
+			if sub, ok := subscriptions[topic]; ok {
+				delete(subscriptions, topic)
+				close(sub.stopped)
+				sub.unsubscribe()
+			}
+		default:
+			if !respond(WSEvent{Stream: cmd.Stream, Error: "Unknown command type"}) {
+				return
+			}
+		}
+	}
+}
+
+// wsForward copies broker messages into the connection events.
+// If the broker drops the subscription without it being stopped,
+// the client fell behind and the connection gets closed.
+func wsForward(conn *websocket.Conn, cmd WSCommand, authUserID string, ch <-chan Message, stopped <-chan struct{}, events chan<- WSEvent, quit <-chan struct{}) {
+	for {
+		msg, ok := <-ch
+		if !ok {
+			select {
+			case <-stopped:
+			default:
+				conn.Close()
+			}
+			return
+		}
+
+		if cmd.Stream == "comments" && msg.ActorID == authUserID {
+			continue
+		}
+
+		select {
+		case events <- WSEvent{Stream: cmd.Stream, Type: msg.Event, PostID: cmd.PostID, ID: msg.ID, Data: msg.Data}:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func wsWriteLoop(conn *websocket.Conn, events <-chan WSEvent, quit <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case <-shuttingDown:
+			// Hijacked connections aren't closed by the server shutdown.
+			// Closing it makes the read loop return.
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			conn.Close()
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				conn.Close()
+				return
+			}
+		case ev := <-events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(ev); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}